@@ -0,0 +1,209 @@
+// Package apitoken stores long-lived API tokens for automation. A token is
+// limited to scopes and is only kept as a hash.
+package apitoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"piControlHelper/utils"
+)
+
+// Prefix starts every token, which tells them apart from session IDs.
+const Prefix = "pct_"
+
+// Scopes a token can be granted.
+const (
+	PackagesRead    = "packages:read"
+	PackagesWrite   = "packages:write"
+	UpdatesApply    = "updates:apply"
+	ServicesRead    = "services:read"
+	ServicesControl = "services:control"
+	UnitsWrite      = "units:write"
+	JobsRead        = "jobs:read"
+	AuditRead       = "audit:read"
+)
+
+// Scopes lists every scope.
+var Scopes = []string{PackagesRead, PackagesWrite, UpdatesApply, ServicesRead, ServicesControl, UnitsWrite, JobsRead, AuditRead}
+
+var ErrNotFound = errors.New("token not found")
+
+type Token struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is nil for tokens that don't expire.
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	// Hash is the SHA-256 hash of the token. It is left out of API
+	// responses.
+	Hash string `json:"hash,omitempty"`
+}
+
+// Allows reports whether the token has the scope.
+func (t Token) Allows(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+// Expired reports whether the token has expired at now.
+func (t Token) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && now.After(*t.ExpiresAt)
+}
+
+// ValidScope reports whether scope is known.
+func ValidScope(scope string) bool {
+	return slices.Contains(Scopes, scope)
+}
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Store keeps tokens in a JSON file. It is safe for concurrent use.
+type Store struct {
+	path string
+
+	mu sync.RWMutex
+	// tokens is keyed by hash
+	tokens map[string]Token
+}
+
+// Open loads the tokens saved at path. A missing file is not an error; it is
+// created when the first token is created.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, tokens: map[string]Token{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token file: %v", err)
+	}
+	var saved []Token
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse token file: %v", err)
+	}
+	for _, t := range saved {
+		s.tokens[t.Hash] = t
+	}
+	return s, nil
+}
+
+// Create stores a new token and returns it with the secret, which is not
+// kept and can't be shown again.
+func (s *Store) Create(name string, scopes []string, createdBy string, expiresAt *time.Time) (Token, string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return Token{}, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return Token{}, "", err
+	}
+	secret = Prefix + secret
+
+	t := Token{
+		ID:        id,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+		Hash:      hash(secret),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[t.Hash] = t
+	return t, secret, s.save()
+}
+
+// Lookup returns the token for a secret. Expired tokens are not returned.
+func (s *Store) Lookup(secret string, now time.Time) (Token, bool) {
+	if !strings.HasPrefix(secret, Prefix) {
+		return Token{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tokens[hash(secret)]
+	if !ok || t.Expired(now) {
+		return Token{}, false
+	}
+	return t, true
+}
+
+// Touch records that a token was used. To spare the disk, the time is only
+// saved when the previous one is older than interval.
+func (s *Store) Touch(t Token, now time.Time, interval time.Duration) error {
+	if t.LastUsedAt != nil && now.Sub(*t.LastUsedAt) < interval {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.tokens[t.Hash]
+	if !ok {
+		return nil
+	}
+	stored.LastUsedAt = &now
+	s.tokens[t.Hash] = stored
+	return s.save()
+}
+
+// List returns the tokens, oldest first.
+func (s *Store) List() []Token {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sorted()
+}
+
+// Revoke deletes the token with the given ID.
+func (s *Store) Revoke(id string) (Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h, t := range s.tokens {
+		if t.ID == id {
+			delete(s.tokens, h)
+			return t, s.save()
+		}
+	}
+	return Token{}, ErrNotFound
+}
+
+func (s *Store) sorted() []Token {
+	list := make([]Token, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, k int) bool { return list[i].CreatedAt.Before(list[k].CreatedAt) })
+	return list
+}
+
+// save writes the tokens atomically. The caller holds s.mu.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(s.path, data)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,275 @@
+// Package audit keeps an append-only log of privileged actions as JSON
+// lines. The file is rotated once it reaches a size limit.
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Results of an entry.
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+	// ResultDenied is a request refused by authentication, a role, a scope
+	// or the lockout.
+	ResultDenied = "denied"
+	// ResultQueued is a request that started a job. The job's outcome is
+	// logged in a second entry with the same job ID.
+	ResultQueued = "queued"
+)
+
+// Entry is one line of the audit log.
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	User   string    `json:"user,omitempty"`
+	// Session identifies a session by a hash of its ID, so entries of one
+	// login can be grouped without the log holding usable session IDs.
+	Session    string         `json:"session,omitempty"`
+	Token      string         `json:"token,omitempty"`
+	IP         string         `json:"ip,omitempty"`
+	Method     string         `json:"method,omitempty"`
+	Path       string         `json:"path,omitempty"`
+	Params     map[string]any `json:"params,omitempty"`
+	Status     int            `json:"status,omitempty"`
+	Result     string         `json:"result"`
+	Message    string         `json:"message,omitempty"`
+	JobID      string         `json:"job_id,omitempty"`
+	DurationMS int64          `json:"duration_ms"`
+}
+
+// Filter selects entries. Empty fields match everything.
+type Filter struct {
+	// Action matches actions starting with it, so "package" matches
+	// "package.install".
+	Action string
+	User   string
+	IP     string
+	Result string
+	JobID  string
+	Since  time.Time
+	Until  time.Time
+	// Limit caps the number of entries returned; 0 means no limit.
+	Limit int
+}
+
+func (f Filter) match(e Entry) bool {
+	return strings.HasPrefix(e.Action, f.Action) &&
+		(f.User == "" || e.User == f.User) &&
+		(f.IP == "" || e.IP == f.IP) &&
+		(f.Result == "" || e.Result == f.Result) &&
+		(f.JobID == "" || e.JobID == f.JobID) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || !e.Time.After(f.Until))
+}
+
+// Log appends entries to a file. When the file would grow past maxSize it is
+// renamed to path.1, path.1 to path.2 and so on, keeping maxFiles old files.
+// It is safe for concurrent use.
+type Log struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Open opens or creates the log at path. Only the owner can read it.
+func Open(path string, maxSize int64, maxFiles int) (*Log, error) {
+	l := &Log{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// Write appends an entry.
+func (l *Log) Write(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// rotate moves the current file aside and starts a new one. The caller
+// holds l.mu.
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(l.rotated(l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		os.Rename(l.rotated(i), l.rotated(i+1))
+	}
+	if l.maxFiles > 0 {
+		if err := os.Rename(l.path, l.rotated(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func (l *Log) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", l.path, i)
+}
+
+// maxLine is the longest line Query reads. Longer ones are skipped.
+const maxLine = 1024 * 1024
+
+// Query returns the entries matching filter, newest first. Files are read
+// backwards from the newest, so only matching entries are kept and reading
+// stops once filter.Limit of them are found.
+func (l *Log) Query(filter Filter) ([]Entry, error) {
+	files, err := l.openFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	entries := []Entry{}
+	for _, file := range files {
+		err := readLinesReverse(file, func(line []byte) bool {
+			// A line that doesn't parse, e.g. one cut short by a crash, is skipped
+			var e Entry
+			if json.Unmarshal(line, &e) != nil || !filter.match(e) {
+				return true
+			}
+			entries = append(entries, e)
+			return filter.Limit <= 0 || len(entries) < filter.Limit
+		})
+		if err != nil {
+			return nil, err
+		}
+		if filter.Limit > 0 && len(entries) == filter.Limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// openFiles opens the current file and the rotated ones, newest first.
+// Rotation renames files, so they are opened under the lock; an open file
+// keeps its content after a rename, so reading them doesn't hold up Write.
+func (l *Log) openFiles() ([]*os.File, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var files []*os.File
+	for i := 0; i <= l.maxFiles; i++ {
+		path := l.path
+		if i > 0 {
+			path = l.rotated(i)
+		}
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// readLinesReverse calls fn with each line of a log file, last line first,
+// until fn returns false. Lines longer than maxLine are skipped.
+func readLinesReverse(file *os.File, fn func(line []byte) bool) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64*1024)
+	// The line being read ends up in parts, last part first
+	var parts [][]byte
+	size, tooLong := 0, false
+	add := func(part []byte) {
+		if tooLong || len(part) == 0 {
+			return
+		}
+		if size+len(part) > maxLine {
+			parts, size, tooLong = nil, 0, true
+			return
+		}
+		parts = append(parts, bytes.Clone(part))
+		size += len(part)
+	}
+	emit := func() bool {
+		line := make([]byte, 0, size)
+		for i := len(parts) - 1; i >= 0; i-- {
+			line = append(line, parts[i]...)
+		}
+		parts, size, tooLong = parts[:0], 0, false
+		return len(line) == 0 || fn(line)
+	}
+
+	for pos := info.Size(); pos > 0; {
+		n := int64(len(buf))
+		if pos < n {
+			n = pos
+		}
+		pos -= n
+		chunk := buf[:n]
+		if _, err := file.ReadAt(chunk, pos); err != nil {
+			return err
+		}
+		for {
+			i := bytes.LastIndexByte(chunk, '\n')
+			if i < 0 {
+				add(chunk)
+				break
+			}
+			add(chunk[i+1:])
+			if !emit() {
+				return nil
+			}
+			chunk = chunk[:i]
+		}
+	}
+	emit()
+	return nil
+}
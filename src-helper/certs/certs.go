@@ -0,0 +1,211 @@
+// Package certs sets up the helper's TLS listener: it generates a
+// self-signed certificate when none is configured, and loads client CAs for
+// mutual TLS.
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// selfSignedValidity is how long a generated certificate is valid. It is
+// pinned by its public key rather than trusted through a CA, so renewing it
+// would gain nothing.
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+// selfSignedOrganization marks the certificates EnsureSelfSigned generated,
+// so a configured one is never replaced.
+const selfSignedOrganization = "PiControl Helper"
+
+// EnsureSelfSigned generates a self-signed certificate for this host unless
+// certFile already holds one covering all of the host's current addresses,
+// e.g. after DHCP handed out a new one. The key is generated once and kept,
+// so clients pinning it keep working. It reports whether it wrote a
+// certificate.
+func EnsureSelfSigned(certFile, keyFile string) (bool, error) {
+	ips := hostIPs()
+	existing, err := readCertificate(certFile)
+	if err == nil && (!selfSigned(existing) || coversIPs(existing, ips)) {
+		return false, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	key, err := ensureKey(keyFile)
+	if err != nil {
+		return false, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return false, err
+	}
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "picontrol-server"
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{selfSignedOrganization}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{hostname, hostname + ".local", "localhost"},
+		IPAddresses:           ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to create certificate: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return false, fmt.Errorf("failed to save certificate: %v", err)
+	}
+	return true, nil
+}
+
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func selfSigned(cert *x509.Certificate) bool {
+	return len(cert.Subject.Organization) == 1 && cert.Subject.Organization[0] == selfSignedOrganization &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// coversIPs reports whether cert is valid for every address in ips.
+func coversIPs(cert *x509.Certificate, ips []net.IP) bool {
+	for _, ip := range ips {
+		if cert.VerifyHostname(ip.String()) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// ensureKey loads the key in keyFile, generating it if there is none yet.
+func ensureKey(keyFile string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(keyFile)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "EC PRIVATE KEY" {
+			return nil, fmt.Errorf("no EC private key found in %s", keyFile)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return nil, fmt.Errorf("failed to save key: %v", err)
+	}
+	return key, nil
+}
+
+// hostIPs returns the addresses of the host's interfaces, so the device can
+// be reached by IP without a name mismatch.
+func hostIPs() []net.IP {
+	ips := []net.IP{}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+// ServerConfig loads the certificate and key. With a client CA file, clients
+// must present a certificate signed by one of its CAs.
+func ServerConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	caPEM, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a TLS certificate's leaf as
+// colon-separated hex, as shown by browsers and openssl.
+func Fingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	return colonHex(sha256.Sum256(cert.Certificate[0]))
+}
+
+// PublicKeyFingerprint returns the SHA-256 hash of the leaf's public key
+// (its DER SubjectPublicKeyInfo) as colon-separated hex. Unlike Fingerprint
+// it stays the same when the certificate is regenerated for new addresses,
+// so the dashboard pins it.
+func PublicKeyFingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return ""
+	}
+	return colonHex(sha256.Sum256(leaf.RawSubjectPublicKeyInfo))
+}
+
+func colonHex(sum [sha256.Size]byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Dir holds the helper's secrets and settings.
+const Dir = "/opt/picontrol-helper/config"
+
+// File is the optional settings file. Missing keys keep their defaults.
+var File = filepath.Join(Dir, "helper.json")
+
+type Config struct {
+	// JobRetention is how long finished jobs stay queryable via /api/jobs.
+	JobRetention Duration `json:"job_retention"`
+	// MaxUploadSize caps the size in bytes of package file uploads to
+	// /api/install/file. Other requests keep Fiber's default limit.
+	MaxUploadSize int `json:"max_upload_size"`
+	// IndexRefreshInterval is how often the package lists and search index
+	// are refreshed in the background.
+	IndexRefreshInterval Duration `json:"index_refresh_interval"`
+	// PackageListsMaxAge is how old the package lists may get before an
+	// install refreshes them first.
+	PackageListsMaxAge Duration `json:"package_lists_max_age"`
+	// AuthLockout limits how fast TOTP codes can be guessed.
+	AuthLockout AuthLockout `json:"auth_lockout"`
+	// TrustedProxies are the addresses of reverse proxies whose
+	// X-Forwarded-For header gives the real client IP, e.g. the web UI's
+	// proxy. Without them every client behind a proxy shares its lockout.
+	TrustedProxies []string `json:"trusted_proxies"`
+	// SessionStore is "file" to keep sessions across restarts in the config
+	// directory, or "memory".
+	SessionStore string `json:"session_store"`
+	// SessionIdleTimeout ends sessions that haven't been used for that long.
+	SessionIdleTimeout Duration `json:"session_idle_timeout"`
+	// SessionMaxLifetime ends sessions that long after the login, however
+	// often they are used or refreshed.
+	SessionMaxLifetime Duration `json:"session_max_lifetime"`
+	// TLS serves the API over HTTPS. It is on by default.
+	TLS TLS `json:"tls"`
+	// Audit is the log of privileged actions.
+	Audit Audit `json:"audit"`
+}
+
+// TLS configures HTTPS and mutual TLS.
+type TLS struct {
+	// Enabled is false only to serve plain HTTP, e.g. behind a reverse
+	// proxy that terminates TLS.
+	Enabled bool `json:"enabled"`
+	// CertFile and KeyFile are PEM files. If they are left empty, a
+	// self-signed certificate is generated in Dir on first start.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ClientCAFile enables mutual TLS: only clients with a certificate
+	// signed by one of its CAs can connect.
+	ClientCAFile string `json:"client_ca_file"`
+}
+
+// AuthLockout configures the lockout after wrong TOTP codes.
+type AuthLockout struct {
+	// MaxFailures is how many wrong codes a client may send before it is
+	// locked out.
+	MaxFailures int `json:"max_failures"`
+	// Lockout is the first lockout. Every further wrong code doubles it, up
+	// to MaxLockout.
+	Lockout    Duration `json:"lockout"`
+	MaxLockout Duration `json:"max_lockout"`
+	// GlobalMaxFailures is how many wrong codes all clients together may
+	// send within GlobalWindow before /auth is locked for everyone.
+	GlobalMaxFailures int      `json:"global_max_failures"`
+	GlobalWindow      Duration `json:"global_window"`
+}
+
+// Audit configures the audit log.
+type Audit struct {
+	// File is the current log. Rotated files get a ".1", ".2", ... suffix,
+	// ".1" being the newest.
+	File string `json:"file"`
+	// MaxSize is the size in bytes at which the file is rotated.
+	MaxSize int64 `json:"max_size"`
+	// MaxFiles is how many rotated files are kept.
+	MaxFiles int `json:"max_files"`
+}
+
+// Duration is a time.Duration that reads and writes as a string like "30m".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30m\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func Default() Config {
+	return Config{
+		JobRetention:         Duration(time.Hour),
+		MaxUploadSize:        256 << 20,
+		IndexRefreshInterval: Duration(6 * time.Hour),
+		PackageListsMaxAge:   Duration(time.Hour),
+		AuthLockout: AuthLockout{
+			MaxFailures:       5,
+			Lockout:           Duration(30 * time.Second),
+			MaxLockout:        Duration(time.Hour),
+			GlobalMaxFailures: 30,
+			GlobalWindow:      Duration(10 * time.Minute),
+		},
+		SessionStore:       "file",
+		SessionIdleTimeout: Duration(25 * time.Minute),
+		SessionMaxLifetime: Duration(24 * time.Hour),
+		TLS:                TLS{Enabled: true},
+		Audit: Audit{
+			File:     filepath.Join(Dir, "audit.log"),
+			MaxSize:  10 << 20,
+			MaxFiles: 5,
+		},
+	}
+}
+
+// Load reads File on top of the defaults. A missing file is not an error.
+func Load() (Config, error) {
+	cfg := Default()
+	data, err := os.ReadFile(File)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config file: %v", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse config file: %v", err)
+	}
+	return cfg, nil
+}
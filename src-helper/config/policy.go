@@ -0,0 +1,87 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// PolicyFile is the optional service policy. It is read on every service
+// action, so edits apply without restarting the helper.
+var PolicyFile = filepath.Join(Dir, "service-policy.json")
+
+// ServicePolicy restricts what the service endpoints may do to units. Unit
+// names may be glob patterns such as "getty@*.service".
+type ServicePolicy struct {
+	// Protected units can't be stopped, disabled, masked, edited or deleted,
+	// so the device stays reachable.
+	Protected []string `json:"protected"`
+	// Allowed lists the only actions permitted on a unit. Units that aren't
+	// listed allow every action.
+	Allowed map[string][]string `json:"allowed"`
+	// Dangerous actions must be repeated with a confirmation token.
+	Dangerous []string `json:"dangerous"`
+	// ConfirmationTTL is how long a confirmation token stays valid.
+	ConfirmationTTL Duration `json:"confirmation_ttl"`
+}
+
+// ProtectedActions are refused on protected units.
+var ProtectedActions = []string{"stop", "disable", "mask", "edit", "delete"}
+
+// DefaultPolicy protects remote access and the helper itself.
+func DefaultPolicy() ServicePolicy {
+	return ServicePolicy{
+		// Newer Ubuntu releases start ssh through socket activation
+		Protected:       []string{"ssh.service", "ssh.socket", "sshd.service", "picontrol-helper.service"},
+		Allowed:         map[string][]string{},
+		Dangerous:       []string{"stop", "disable", "mask", "edit", "delete"},
+		ConfirmationTTL: Duration(2 * time.Minute),
+	}
+}
+
+// LoadPolicy reads PolicyFile on top of the default policy. A missing file is
+// not an error.
+func LoadPolicy() (ServicePolicy, error) {
+	policy := DefaultPolicy()
+	data, err := os.ReadFile(PolicyFile)
+	if os.IsNotExist(err) {
+		return policy, nil
+	}
+	if err != nil {
+		return policy, fmt.Errorf("failed to read service policy: %v", err)
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return policy, fmt.Errorf("failed to parse service policy: %v", err)
+	}
+	return policy, nil
+}
+
+// Check returns why action is not allowed on unit, or "" if it is.
+func (p ServicePolicy) Check(unit, action string) string {
+	if slices.Contains(ProtectedActions, action) && matchUnit(p.Protected, unit) {
+		return fmt.Sprintf("Action %s is not allowed on protected unit %s", action, unit)
+	}
+	for pattern, actions := range p.Allowed {
+		if match(pattern, unit) && !slices.Contains(actions, action) {
+			return fmt.Sprintf("Action %s is not allowed on %s", action, unit)
+		}
+	}
+	return ""
+}
+
+// NeedsConfirmation reports whether action must be confirmed.
+func (p ServicePolicy) NeedsConfirmation(action string) bool {
+	return slices.Contains(p.Dangerous, action)
+}
+
+func matchUnit(patterns []string, unit string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool { return match(pattern, unit) })
+}
+
+func match(pattern, unit string) bool {
+	matched, err := filepath.Match(pattern, unit)
+	return err == nil && matched
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"piControlHelper/apitoken"
+	"piControlHelper/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var apiTokens *apitoken.Store
+
+// tokenTouchInterval is how often a token's last use is saved.
+const tokenTouchInterval = time.Minute
+
+// InitializeAPITokens loads the API tokens from the config directory
+func InitializeAPITokens() error {
+	store, err := apitoken.Open(filepath.Join(configDir, "api_tokens.json"))
+	if err != nil {
+		return err
+	}
+	apiTokens = store
+	return nil
+}
+
+// ValidateAPIToken checks a token and records its use
+func ValidateAPIToken(secret string) (apitoken.Token, bool) {
+	now := time.Now()
+	token, valid := apiTokens.Lookup(secret, now)
+	if !valid {
+		return apitoken.Token{}, false
+	}
+	if err := apiTokens.Touch(token, now, tokenTouchInterval); err != nil {
+		log.Println("Failed to save API token use:", err)
+	}
+	return token, true
+}
+
+// ListAPITokens returns every API token, without the secrets
+func ListAPITokens(c *fiber.Ctx) error {
+	tokens := apiTokens.List()
+	for i := range tokens {
+		tokens[i].Hash = ""
+	}
+	return c.JSON(fiber.Map{"success": true, "tokens": tokens, "scopes": apitoken.Scopes})
+}
+
+// CreateAPIToken creates a token with the given scopes. The secret is only
+// returned here.
+func CreateAPIToken(c *fiber.Ctx) error {
+	var body struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+		// ExpiresIn is optional, tokens don't expire by default
+		ExpiresIn config.Duration `json:"expires_in"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Request must be JSON, with expires_in like \"720h\""})
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" || len(body.Name) > 64 {
+		return c.Status(400).JSON(fiber.Map{"error": "Token name required, up to 64 characters"})
+	}
+	if len(body.Scopes) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "At least one scope required"})
+	}
+	for _, scope := range body.Scopes {
+		if !apitoken.ValidScope(scope) {
+			return c.Status(400).JSON(fiber.Map{"error": "Unknown scope " + scope, "scopes": apitoken.Scopes})
+		}
+	}
+	if body.ExpiresIn < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "expires_in must be positive"})
+	}
+
+	var expiresAt *time.Time
+	if body.ExpiresIn > 0 {
+		t := time.Now().Add(time.Duration(body.ExpiresIn))
+		expiresAt = &t
+	}
+	token, secret, err := apiTokens.Create(body.Name, body.Scopes, currentUser(c), expiresAt)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"success": false, "message": err.Error()})
+	}
+
+	log.Printf("🔑 API token %s (%s) created by %s", token.Name, strings.Join(token.Scopes, ","), currentUser(c))
+	token.Hash = ""
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"token":   secret,
+		"info":    token,
+		"message": "Store the token now, it can't be shown again",
+	})
+}
+
+// RevokeAPIToken deletes a token, which stops working immediately
+func RevokeAPIToken(c *fiber.Ctx) error {
+	id := c.Params("id")
+	token, err := apiTokens.Revoke(id)
+	if errors.Is(err, apitoken.ErrNotFound) {
+		return c.Status(404).JSON(fiber.Map{"success": false, "message": "Token " + id + " not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"success": false, "message": err.Error()})
+	}
+
+	log.Printf("🔑 API token %s revoked by %s", token.Name, currentUser(c))
+	return c.JSON(fiber.Map{"success": true, "message": "Token " + token.Name + " revoked"})
+}
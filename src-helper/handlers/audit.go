@@ -0,0 +1,346 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"piControlHelper/apitoken"
+	"piControlHelper/audit"
+	"piControlHelper/config"
+	"piControlHelper/jobs"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var auditLog *audit.Log
+
+// pendingAudits holds the entries of queued requests until their job
+// finishes, keyed by job ID.
+var (
+	auditMu       sync.Mutex
+	pendingAudits = map[string]audit.Entry{}
+)
+
+// auditRedacted are request fields left out of the audit log.
+var auditRedacted = map[string]bool{
+	"totp_code":     true,
+	"refresh_token": true,
+	"session_id":    true,
+	"confirm_token": true,
+	"token":         true,
+}
+
+// auditMaxValue is the longest string kept in an entry's parameters, so a
+// unit file doesn't end up in the log in full.
+const auditMaxValue = 1024
+
+// auditMaxParams caps the encoded size of an entry's parameters, which may
+// nest lists and objects that auditMaxValue alone doesn't cut short.
+const auditMaxParams = 16 * 1024
+
+// maxAuditEntries caps the entries returned by /api/audit.
+const maxAuditEntries = 1000
+
+// InitializeAudit opens the audit log. It runs after InitializeJobs, since
+// the outcome of every job is logged as well.
+func InitializeAudit(cfg config.Audit) error {
+	l, err := audit.Open(cfg.File, cfg.MaxSize, cfg.MaxFiles)
+	if err != nil {
+		return err
+	}
+	auditLog = l
+	jobManager.OnFinish(auditJobFinished)
+	return nil
+}
+
+func writeAudit(e audit.Entry) {
+	if auditLog == nil {
+		return
+	}
+	if err := auditLog.Write(e); err != nil {
+		log.Println("Failed to write audit log:", err)
+	}
+}
+
+// sessionRef identifies a session in the audit log without revealing its ID.
+func sessionRef(id string) string {
+	if id == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// auditIdentity fills in who made a request from the locals set by
+// AuthMiddleware. It takes the locals getter of a fiber or WebSocket
+// connection.
+func auditIdentity(e *audit.Entry, locals func(key string) any) {
+	e.User, _ = locals("user").(string)
+	if id, ok := locals("session").(string); ok {
+		e.Session = sessionRef(id)
+	}
+	if token, ok := locals("token").(apitoken.Token); ok {
+		e.Token = token.ID
+	}
+	if ip, ok := locals("ip").(string); ok {
+		e.IP = ip
+	}
+}
+
+// Audit logs every request to the route under action, with its parameters,
+// result and duration. Put it before Require, so refused requests are
+// logged too. Requests that start a job get a second entry when it
+// finishes.
+func Audit(action string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		e := audit.Entry{
+			Time:   start,
+			Action: action,
+			IP:     c.IP(),
+			Method: c.Method(),
+			Path:   c.Path(),
+			Params: auditParams(c),
+			Status: c.Response().StatusCode(),
+		}
+		auditIdentity(&e, func(key string) any { return c.Locals(key) })
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) {
+			e.Status, e.Message = fiberErr.Code, fiberErr.Message
+		} else if err != nil {
+			e.Status, e.Message = fiber.StatusInternalServerError, err.Error()
+		}
+
+		var body struct {
+			Success   *bool           `json:"success"`
+			Message   string          `json:"message"`
+			Error     string          `json:"error"`
+			JobID     string          `json:"job_id"`
+			SessionID string          `json:"session_id"`
+			Results   []PackageResult `json:"results"`
+		}
+		// Fields of another type are skipped, which is fine here
+		json.Unmarshal(c.Response().Body(), &body)
+		if e.Message == "" {
+			e.Message = body.Message
+			if body.Error != "" {
+				e.Message = body.Error
+			}
+		}
+		// An upgrade's message is the package manager's whole output
+		e.Message = auditTruncate(e.Message)
+		if body.SessionID != "" {
+			// A login or refresh is attributed to the session it created
+			e.Session = sessionRef(body.SessionID)
+		}
+		success := body.Success
+		if err := failedPackages(body.Results); success == nil && err != nil {
+			failed := false
+			success = &failed
+			e.Message = err.Error()
+		}
+		e.Result = auditResult(e.Status, success)
+		e.DurationMS = time.Since(start).Milliseconds()
+
+		queued := e.Status == fiber.StatusAccepted && body.JobID != ""
+		if queued {
+			e.Result, e.JobID = audit.ResultQueued, body.JobID
+		}
+		writeAudit(e)
+		if queued {
+			queueAudit(e)
+		}
+		return err
+	}
+}
+
+// auditResult classifies a response by its status and success field.
+func auditResult(status int, success *bool) string {
+	switch {
+	case status == fiber.StatusUnauthorized, status == fiber.StatusForbidden,
+		status == fiber.StatusPreconditionRequired, status == fiber.StatusTooManyRequests:
+		return audit.ResultDenied
+	case status >= 400, success != nil && !*success:
+		return audit.ResultFailure
+	}
+	return audit.ResultSuccess
+}
+
+// auditParams returns the parameters of a request: route and query
+// parameters and the JSON body, without secrets and with long values cut
+// short. Uploaded files are listed by name. Past auditMaxParams, large
+// values are replaced by their size.
+func auditParams(c *fiber.Ctx) map[string]any {
+	params := map[string]any{}
+	for key, value := range c.AllParams() {
+		params[key] = value
+	}
+	c.Context().QueryArgs().VisitAll(func(key, value []byte) {
+		params[string(key)] = string(value)
+	})
+	if strings.HasPrefix(string(c.Request().Header.ContentType()), fiber.MIMEMultipartForm) {
+		if form, err := c.MultipartForm(); err == nil {
+			for field, files := range form.File {
+				names := []string{}
+				for _, file := range files {
+					names = append(names, file.Filename)
+				}
+				params[field] = names
+			}
+		}
+	} else {
+		var body map[string]any
+		if json.Unmarshal(c.Body(), &body) == nil {
+			for key, value := range body {
+				params[key] = value
+			}
+		}
+	}
+
+	for key, value := range params {
+		if auditRedacted[key] {
+			params[key] = "[redacted]"
+		} else if s, ok := value.(string); ok {
+			params[key] = auditTruncate(s)
+		}
+	}
+	if len(params) == 0 {
+		return nil
+	}
+
+	encoded, _ := json.Marshal(params)
+	if len(encoded) <= auditMaxParams {
+		return params
+	}
+	size := 0
+	for key, value := range params {
+		value, _ := json.Marshal(value)
+		if len(value) > auditMaxValue {
+			params[key] = "(" + strconv.Itoa(len(value)) + " bytes)"
+			value = nil
+		}
+		size += len(key) + len(value)
+	}
+	if size > auditMaxParams {
+		// Many small values, e.g. a list of thousands of packages
+		return map[string]any{"truncated": "(" + strconv.Itoa(len(encoded)) + " bytes)"}
+	}
+	return params
+}
+
+// auditTruncate cuts a string down to auditMaxValue bytes.
+func auditTruncate(s string) string {
+	if len(s) <= auditMaxValue {
+		return s
+	}
+	return s[:auditMaxValue] + "... (" + strconv.Itoa(len(s)) + " bytes)"
+}
+
+// queueAudit keeps a queued request's entry until its job finishes, or logs
+// the outcome right away if the job is already done.
+func queueAudit(e audit.Entry) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if job, ok := jobManager.Get(e.JobID); ok {
+		if snap := job.Snapshot(); snap.FinishedAt != nil {
+			writeAudit(jobOutcome(e, snap))
+			return
+		}
+	}
+	pendingAudits[e.JobID] = e
+}
+
+func auditJobFinished(snap jobs.Snapshot) {
+	auditMu.Lock()
+	e, ok := pendingAudits[snap.ID]
+	delete(pendingAudits, snap.ID)
+	auditMu.Unlock()
+	if ok {
+		writeAudit(jobOutcome(e, snap))
+	}
+}
+
+// jobOutcome turns the entry of a queued request into the one logged when
+// its job finishes. Its duration counts from the request.
+func jobOutcome(e audit.Entry, snap jobs.Snapshot) audit.Entry {
+	start, finishedAt := e.Time, time.Now()
+	if snap.FinishedAt != nil {
+		finishedAt = *snap.FinishedAt
+	}
+	e.Time = finishedAt
+	e.Status = 0
+	e.Result, e.Message = audit.ResultSuccess, ""
+	if snap.Status == jobs.StatusFailed {
+		e.Result, e.Message = audit.ResultFailure, snap.Error
+	}
+	e.DurationMS = finishedAt.Sub(start).Milliseconds()
+	return e
+}
+
+// GetAuditLog returns audit entries, newest first. They can be filtered by
+// user, action prefix, IP, result, job and time.
+func GetAuditLog(c *fiber.Ctx) error {
+	filter := audit.Filter{
+		Action: c.Query("action"),
+		User:   c.Query("user"),
+		IP:     c.Query("ip"),
+		Result: c.Query("result"),
+		JobID:  c.Query("job_id"),
+	}
+
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit < 1 {
+		return c.Status(400).JSON(fiber.Map{"error": "limit must be a positive number"})
+	}
+	filter.Limit = min(limit, maxAuditEntries)
+
+	now := time.Now()
+	if filter.Since, err = parseAuditTime(c.Query("since"), now); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "since must be an RFC 3339 time or a duration such as 24h"})
+	}
+	if filter.Until, err = parseAuditTime(c.Query("until"), now); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "until must be an RFC 3339 time or a duration such as 24h"})
+	}
+
+	entries, err := auditLog.Query(filter)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"success": false, "message": err.Error()})
+	}
+	return c.JSON(fiber.Map{"success": true, "entries": entries})
+}
+
+// parseAuditTime reads an RFC 3339 time, or a duration meaning that long
+// before now. An empty value is the zero time.
+func parseAuditTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// auditDenied logs a request refused before it reached an audited route,
+// e.g. one with an invalid session.
+func auditDenied(c *fiber.Ctx, action, message string) {
+	writeAudit(audit.Entry{
+		Time:    time.Now(),
+		Action:  action,
+		IP:      c.IP(),
+		Method:  c.Method(),
+		Path:    c.Path(),
+		Status:  fiber.StatusUnauthorized,
+		Result:  audit.ResultDenied,
+		Message: message,
+	})
+}
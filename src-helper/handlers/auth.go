@@ -3,92 +3,191 @@ package handlers
 import (
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base32"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"piControlHelper/apitoken"
+	"piControlHelper/config"
+	"piControlHelper/session"
+	"piControlHelper/users"
+
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 	"github.com/skip2/go-qrcode"
 )
 
 var (
-	sessions     = make(map[string]*Session)
-	totpSecret   string
-	configDir    = "/opt/picontrol-helper/config"
+	sessions     session.Store = session.NewMemoryStore()
+	userStore    *users.Store
+	configDir    = config.Dir
 	secretFile   = filepath.Join(configDir, "totp_secret.json")
+	usersFile    = filepath.Join(configDir, "users.json")
 	sessionValid = 25 * time.Minute
 )
 
-type Session struct {
-	ID        string    `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	ExpiresAt time.Time `json:"expires_at"`
-}
+// totpPeriod is the length of a TOTP time step in seconds.
+const totpPeriod = 30
+
+// defaultUser logs in when /auth is called without a username. It is the
+// account created at setup, or migrated from the single secret used before
+// there were user accounts.
+const defaultUser = "admin"
+
+// totpMu serializes checking codes, so each code is accepted only once.
+var totpMu sync.Mutex
+
+// sessionJanitorInterval is how often expired sessions are removed.
+const sessionJanitorInterval = time.Minute
+
+// sessionTouchInterval is how far a session's expiry must move before it is
+// saved again, so the file store isn't rewritten on every request.
+const sessionTouchInterval = time.Minute
+
+// sessionMaxLifetime is how long a session can be kept alive by use and
+// refreshes. sessionValid is the idle timeout.
+var (
+	sessionMaxLifetime = 24 * time.Hour
+	refreshMu          sync.Mutex
+)
 
+// TOTPConfig is the secret file used before there were user accounts.
 type TOTPConfig struct {
 	Secret      string    `json:"secret"`
 	QRCodePath  string    `json:"qr_code_path"`
 	AccountName string    `json:"account_name"`
 	Issuer      string    `json:"issuer"`
 	CreatedAt   time.Time `json:"created_at"`
+	// LastUsedStep survives restarts, so a code can't be replayed right
+	// after one.
+	LastUsedStep int64 `json:"last_used_step,omitempty"`
 }
 
 type AuthRequest struct {
+	Username string `json:"username"`
 	TOTPCode string `json:"totp_code"`
 }
 
 type AuthResponse struct {
-	Success   bool   `json:"success"`
-	SessionID string `json:"session_id,omitempty"`
-	ExpiresAt string `json:"expires_at,omitempty"`
-	Message   string `json:"message,omitempty"`
+	Success      bool   `json:"success"`
+	SessionID    string `json:"session_id,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresAt    string `json:"expires_at,omitempty"`
+	MaxExpiresAt string `json:"max_expires_at,omitempty"`
+	Message      string `json:"message,omitempty"`
+}
+
+type RefreshRequest struct {
+	SessionID    string `json:"session_id"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// InitializeSessions opens the session store: "file" keeps sessions across
+// restarts, "memory" doesn't. Sessions expire after idleTimeout without use
+// and end maxLifetime after the login. Ended sessions are removed in the
+// background.
+func InitializeSessions(store string, idleTimeout, maxLifetime time.Duration) error {
+	sessionValid = idleTimeout
+	sessionMaxLifetime = maxLifetime
+	switch store {
+	case "memory":
+		sessions = session.NewMemoryStore()
+	case "file":
+		fileStore, err := session.NewFileStore(filepath.Join(configDir, "sessions.json"))
+		if err != nil {
+			return err
+		}
+		sessions = fileStore
+	default:
+		return fmt.Errorf("unknown session store %q", store)
+	}
+	session.StartJanitor(sessions, sessionJanitorInterval)
+	return nil
 }
 
-// InitializeAuth sets up the TOTP secret and generates QR code if needed
+// InitializeAuth loads the user accounts, creating the admin account and
+// showing its QR code on first startup.
 func InitializeAuth() error {
 	// Create config directory if it doesn't exist
 	if err := os.MkdirAll(configDir, 0750); err != nil {
 		return fmt.Errorf("failed to create config directory: %v", err)
 	}
 
-	// Check if TOTP secret already exists
-	if _, err := os.Stat(secretFile); os.IsNotExist(err) {
-		return generateNewTOTPSecret()
+	store, err := users.Open(usersFile)
+	if err != nil {
+		return err
+	}
+	userStore = store
+	if userStore.Count() > 0 {
+		log.Printf("🔐 TOTP authentication loaded for %d users", userStore.Count())
+		return nil
 	}
 
-	// Load existing secret
-	return loadTOTPSecret()
+	// An existing authenticator entry keeps working as the admin account
+	if _, err := os.Stat(secretFile); err == nil {
+		return migrateTOTPSecret()
+	}
+	return createFirstAdmin()
 }
 
-func generateNewTOTPSecret() error {
+func createFirstAdmin() error {
 	log.Println("🔐 Setting up TOTP authentication for first time...")
 
-	// Generate a new secret
-	secret := make([]byte, 20)
-	_, err := rand.Read(secret)
+	user, key, err := newTOTPUser(defaultUser, users.Admin)
 	if err != nil {
-		return fmt.Errorf("failed to generate random secret: %v", err)
+		return err
+	}
+	if err := userStore.Add(user); err != nil {
+		return fmt.Errorf("failed to save users: %v", err)
 	}
 
-	totpSecret = base32.StdEncoding.EncodeToString(secret)
+	// Display QR code in terminal
+	displayQRCodeInTerminal(key.URL())
+
+	log.Println("✅ TOTP authentication setup complete!")
+	log.Printf("👤 User: %s (%s)", user.Name, user.Role)
+	log.Printf("🔑 Secret saved to: %s", usersFile)
+	log.Println("📲 Scan the QR code with your authenticator app (Google Authenticator, Authy, etc.)")
+	log.Printf("🏷️  Account: %s", user.AccountName)
+	log.Printf("🏢 Issuer: %s", user.Issuer)
+	log.Println("⚠️  Keep the users file secure - it's needed for authentication!")
 
+	return nil
+}
+
+// newTOTPUser returns a user with a new TOTP secret, and the key to enroll
+// it in an authenticator app. The user isn't saved.
+func newTOTPUser(name string, role users.Role) (users.User, *otp.Key, error) {
 	// Get hostname for account name
 	hostname, _ := os.Hostname()
 	if hostname == "" {
 		hostname = "picontrol-server"
 	}
 
-	accountName := fmt.Sprintf("PiControl@%s", hostname)
+	accountName := fmt.Sprintf("%s@%s", name, hostname)
 	issuer := "PiControl Helper"
 
+	// Generate a new secret
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return users.User{}, nil, fmt.Errorf("failed to generate random secret: %v", err)
+	}
+
 	// Generate TOTP key - the library expects the secret to be provided as raw bytes
 	key, err := totp.Generate(totp.GenerateOpts{
 		Issuer:      issuer,
@@ -96,55 +195,22 @@ func generateNewTOTPSecret() error {
 		Secret:      secret,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to generate TOTP key: %v", err)
+		return users.User{}, nil, fmt.Errorf("failed to generate TOTP key: %v", err)
 	}
 
-	// Generate QR code using the URL from the TOTP key
-	qrCodePath := filepath.Join(configDir, "totp_qr.png")
-	qrCode, err := qrcode.Encode(key.URL(), qrcode.Medium, 256)
-	if err != nil {
-		return fmt.Errorf("failed to generate QR code: %v", err)
-	}
-
-	err = ioutil.WriteFile(qrCodePath, qrCode, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to save QR code: %v", err)
-	}
-
-	// Save config
-	config := TOTPConfig{
-		Secret:      totpSecret,
-		QRCodePath:  qrCodePath,
+	return users.User{
+		Name:        name,
+		Role:        role,
+		Secret:      base32.StdEncoding.EncodeToString(secret),
 		AccountName: accountName,
 		Issuer:      issuer,
 		CreatedAt:   time.Now(),
-	}
-
-	configData, err := json.MarshalIndent(config, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal config: %v", err)
-	}
-
-	err = ioutil.WriteFile(secretFile, configData, 0600)
-	if err != nil {
-		return fmt.Errorf("failed to save config: %v", err)
-	}
-
-	// Display QR code in terminal
-	displayQRCodeInTerminal(key.URL())
-
-	log.Println("✅ TOTP authentication setup complete!")
-	log.Printf("📱 QR code saved to: %s", qrCodePath)
-	log.Printf("🔑 Secret backup saved to: %s", secretFile)
-	log.Println("📲 Scan the QR code with your authenticator app (Google Authenticator, Authy, etc.)")
-	log.Printf("🏷️  Account: %s", accountName)
-	log.Printf("🏢 Issuer: %s", issuer)
-	log.Println("⚠️  Keep the secret file secure - it's needed for authentication!")
-
-	return nil
+	}, key, nil
 }
 
-func loadTOTPSecret() error {
+// migrateTOTPSecret turns the secret file used before there were user
+// accounts into the admin account, and removes it and its QR code.
+func migrateTOTPSecret() error {
 	data, err := ioutil.ReadFile(secretFile)
 	if err != nil {
 		return fmt.Errorf("failed to read secret file: %v", err)
@@ -156,11 +222,44 @@ func loadTOTPSecret() error {
 		return fmt.Errorf("failed to parse secret file: %v", err)
 	}
 
-	totpSecret = config.Secret
-	log.Println("🔐 TOTP authentication loaded from existing configuration")
+	err = userStore.Add(users.User{
+		Name:         defaultUser,
+		Role:         users.Admin,
+		Secret:       config.Secret,
+		AccountName:  config.AccountName,
+		Issuer:       config.Issuer,
+		CreatedAt:    config.CreatedAt,
+		LastUsedStep: config.LastUsedStep,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save users: %v", err)
+	}
+	os.Remove(secretFile)
+	if config.QRCodePath != "" {
+		os.Remove(config.QRCodePath)
+	}
+
+	log.Printf("🔐 TOTP secret moved to user %q in %s", defaultUser, usersFile)
 	return nil
 }
 
+// enrollment describes how to add a user's secret to an authenticator app.
+func enrollment(user users.User, url string) (fiber.Map, error) {
+	qrCode, err := qrcode.Encode(url, qrcode.Medium, 256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate QR code: %v", err)
+	}
+	return fiber.Map{
+		"username":     user.Name,
+		"role":         user.Role,
+		"account_name": user.AccountName,
+		"issuer":       user.Issuer,
+		"secret":       user.Secret,
+		"otpauth_url":  url,
+		"qr_code":      "data:image/png;base64," + base64.StdEncoding.EncodeToString(qrCode),
+	}, nil
+}
+
 func displayQRCodeInTerminal(url string) {
 	// Generate ASCII QR code for terminal display
 	qr, err := qrcode.New(url, qrcode.Medium)
@@ -198,33 +297,43 @@ func AuthenticateHandler(c *fiber.Ctx) error {
 			Message: "TOTP code is required",
 		})
 	}
+	if req.Username == "" {
+		req.Username = defaultUser
+	}
+	c.Locals("user", req.Username)
 
-	// Validate TOTP code with time skew tolerance
-	valid := totp.Validate(req.TOTPCode, totpSecret)
-	if !valid {
-		// Try with previous and next time windows for clock skew tolerance
-		now := time.Now()
-		prev := now.Add(-30 * time.Second)
-		next := now.Add(30 * time.Second)
-
-		prevCode, _ := totp.GenerateCode(totpSecret, prev)
-		nextCode, _ := totp.GenerateCode(totpSecret, next)
-
-		if req.TOTPCode == prevCode || req.TOTPCode == nextCode {
-			valid = true
-		}
+	// Locked out clients don't get their code checked at all. Every other
+	// attempt counts as a wrong code until the code turns out valid.
+	wait, attempt := authLimiter.begin(c.IP())
+	if wait > 0 {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter(wait)))
+		return c.Status(429).JSON(AuthResponse{
+			Success: false,
+			Message: fmt.Sprintf("Too many invalid TOTP codes. Try again in %s", wait.Round(time.Second)),
+		})
 	}
 
+	valid, replayed := acceptTOTPCode(req.Username, req.TOTPCode, time.Now())
+	if replayed {
+		log.Printf("⚠️  Reused TOTP code for %s from %s", req.Username, c.IP())
+		return c.Status(401).JSON(AuthResponse{
+			Success: false,
+			Message: "TOTP code has already been used",
+		})
+	}
 	if !valid {
-		log.Printf("⚠️  Invalid TOTP attempt from %s", c.IP())
+		log.Printf("⚠️  Invalid TOTP attempt for %s from %s", req.Username, c.IP())
 		return c.Status(401).JSON(AuthResponse{
 			Success: false,
 			Message: "Invalid TOTP code",
 		})
 	}
 
+	authLimiter.succeed(c.IP(), attempt)
+
 	// Generate session
-	sessionID, expiresAt, err := createSession()
+	now := time.Now()
+	s, refreshToken, err := createSession(req.Username, now, now.Add(sessionMaxLifetime))
 	if err != nil {
 		return c.Status(500).JSON(AuthResponse{
 			Success: false,
@@ -232,77 +341,221 @@ func AuthenticateHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	log.Printf("✅ Successful authentication from %s, session: %s", c.IP(), sessionID[:8]+"...")
+	log.Printf("✅ Successful authentication of %s from %s, session: %s", req.Username, c.IP(), s.ID[:8]+"...")
 
 	return c.JSON(AuthResponse{
-		Success:   true,
-		SessionID: sessionID,
-		ExpiresAt: expiresAt.Format(time.RFC3339),
-		Message:   "Authentication successful",
+		Success:      true,
+		SessionID:    s.ID,
+		RefreshToken: refreshToken,
+		ExpiresAt:    s.ExpiresAt.Format(time.RFC3339),
+		MaxExpiresAt: s.MaxExpiresAt.Format(time.RFC3339),
+		Message:      "Authentication successful",
 	})
 }
 
-func createSession() (string, time.Time, error) {
-	// Generate session ID
-	sessionBytes := make([]byte, 32)
-	_, err := rand.Read(sessionBytes)
-	if err != nil {
-		return "", time.Time{}, err
+// RefreshHandler swaps a session and its refresh token for new ones. It also
+// works once the session has expired from inactivity, but not past its
+// maximum lifetime. The old session ID and refresh token stop working.
+func RefreshHandler(c *fiber.Ctx) error {
+	var req RefreshRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(AuthResponse{
+			Success: false,
+			Message: "Invalid JSON body",
+		})
+	}
+
+	if req.SessionID == "" || req.RefreshToken == "" {
+		return c.Status(400).JSON(AuthResponse{
+			Success: false,
+			Message: "Session ID and refresh token are required",
+		})
 	}
 
-	hash := sha256.Sum256(sessionBytes)
-	sessionID := hex.EncodeToString(hash[:])
+	// Serialized, so a refresh token can't be used twice concurrently
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+
+	old, exists := sessions.Get(req.SessionID)
+	hash := sha256.Sum256([]byte(req.RefreshToken))
+	if !exists || subtle.ConstantTimeCompare([]byte(old.RefreshHash), []byte(hex.EncodeToString(hash[:]))) != 1 {
+		log.Printf("⚠️  Invalid refresh token from %s", c.IP())
+		return c.Status(401).JSON(AuthResponse{
+			Success: false,
+			Message: "Invalid refresh token",
+		})
+	}
+
+	c.Locals("user", old.User)
+	c.Locals("session", req.SessionID)
 
 	now := time.Now()
-	expiresAt := now.Add(sessionValid)
+	if old.Ended(now) {
+		sessions.Delete(req.SessionID)
+		return c.Status(401).JSON(AuthResponse{
+			Success: false,
+			Message: "Session has reached its maximum lifetime, authenticate again",
+		})
+	}
+
+	s, refreshToken, err := createSession(old.User, old.CreatedAt, old.MaxExpiresAt)
+	if err != nil {
+		return c.Status(500).JSON(AuthResponse{
+			Success: false,
+			Message: "Failed to create session",
+		})
+	}
+	if err := sessions.Delete(req.SessionID); err != nil {
+		log.Println("Failed to delete session:", err)
+	}
+
+	return c.JSON(AuthResponse{
+		Success:      true,
+		SessionID:    s.ID,
+		RefreshToken: refreshToken,
+		ExpiresAt:    s.ExpiresAt.Format(time.RFC3339),
+		MaxExpiresAt: s.MaxExpiresAt.Format(time.RFC3339),
+		Message:      "Session refreshed",
+	})
+}
+
+// acceptTOTPCode checks a user's code against the current time step and one
+// step either side, for clock skew. A valid code is only accepted once: its
+// step becomes the user's last used one, and codes from that step or earlier
+// are reported as replayed (RFC 6238, section 5.2).
+func acceptTOTPCode(username, code string, now time.Time) (valid, replayed bool) {
+	totpMu.Lock()
+	defer totpMu.Unlock()
+
+	user, exists := userStore.Get(username)
+	if !exists {
+		return false, false
+	}
+
+	step, valid := codeStep(user.Secret, code, now)
+	if !valid {
+		return false, false
+	}
+	if step <= user.LastUsedStep {
+		return false, true
+	}
+	_, err := userStore.Update(username, func(u *users.User) { u.LastUsedStep = step })
+	if err != nil {
+		log.Println("Failed to save last used TOTP step:", err)
+	}
+	return true, false
+}
 
-	session := &Session{
-		ID:        sessionID,
-		CreatedAt: now,
-		ExpiresAt: expiresAt,
+// codeStep returns the time step at which secret generates code, looking at
+// the current step and one either side.
+func codeStep(secret, code string, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current + 1; step >= current-1; step-- {
+		expected, err := totp.GenerateCode(secret, time.Unix(step*totpPeriod, 0))
+		if err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// createSession stores a new session of user for a login at createdAt that
+// ends at maxExpiresAt, and returns it with its refresh token.
+func createSession(user string, createdAt, maxExpiresAt time.Time) (session.Session, string, error) {
+	sessionID, err := randomToken()
+	if err != nil {
+		return session.Session{}, "", err
 	}
+	refreshToken, err := randomToken()
+	if err != nil {
+		return session.Session{}, "", err
+	}
+	refreshHash := sha256.Sum256([]byte(refreshToken))
 
-	sessions[sessionID] = session
+	s := session.Session{
+		ID:           sessionID,
+		User:         user,
+		CreatedAt:    createdAt,
+		ExpiresAt:    slideExpiry(time.Now(), maxExpiresAt),
+		MaxExpiresAt: maxExpiresAt,
+		RefreshHash:  hex.EncodeToString(refreshHash[:]),
+	}
+	if err := sessions.Put(s); err != nil {
+		return session.Session{}, "", err
+	}
 
-	// Clean up expired sessions
-	go cleanupExpiredSessions()
+	return s, refreshToken, nil
+}
 
-	return sessionID, expiresAt, nil
+func randomToken() (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(tokenBytes)
+	return hex.EncodeToString(hash[:]), nil
 }
 
-func cleanupExpiredSessions() {
+// slideExpiry returns when a session used at now expires: after the idle
+// timeout, but never past its maximum lifetime.
+func slideExpiry(now, maxExpiresAt time.Time) time.Time {
+	expiresAt := now.Add(sessionValid)
+	if !maxExpiresAt.IsZero() && expiresAt.After(maxExpiresAt) {
+		return maxExpiresAt
+	}
+	return expiresAt
+}
+
+// ValidateSession checks if a session is valid and pushes its expiry back,
+// so sessions only expire when they aren't used. It returns the session's
+// user.
+func ValidateSession(sessionID string) (users.User, bool) {
+	s, exists := sessions.Get(sessionID)
+	if !exists {
+		return users.User{}, false
+	}
+
 	now := time.Now()
-	for id, session := range sessions {
-		if now.After(session.ExpiresAt) {
-			delete(sessions, id)
+	if now.After(s.ExpiresAt) {
+		// An idle session can still be refreshed until it ends
+		if s.Ended(now) {
+			sessions.Delete(sessionID)
 		}
+		return users.User{}, false
 	}
-}
 
-// ValidateSession checks if a session is valid
-func ValidateSession(sessionID string) bool {
-	session, exists := sessions[sessionID]
+	// Sessions of deleted users, and from before there were users, are void
+	user, exists := userStore.Get(s.User)
 	if !exists {
-		return false
+		sessions.Delete(sessionID)
+		return users.User{}, false
 	}
 
-	if time.Now().After(session.ExpiresAt) {
-		delete(sessions, sessionID)
-		return false
+	if expiresAt := slideExpiry(now, s.MaxExpiresAt); expiresAt.Sub(s.ExpiresAt) >= sessionTouchInterval {
+		s.ExpiresAt = expiresAt
+		if err := sessions.Put(s); err != nil {
+			log.Println("Failed to extend session:", err)
+		}
 	}
 
-	return true
+	return user, true
 }
 
 // AuthMiddleware protects endpoints with session validation
 func AuthMiddleware(c *fiber.Ctx) error {
 	// Check for session ID in Authorization header
 	authHeader := c.Get("Authorization")
+	if authHeader == "" && websocket.IsWebSocketUpgrade(c) {
+		// Browsers cannot set headers on WebSocket handshakes
+		authHeader = c.Query("token")
+	}
 	if authHeader == "" {
 		return c.Status(401).JSON(fiber.Map{
 			"error": "Authorization header required",
 		})
 	}
+	// Kept for handlers that only see the WebSocket connection
+	c.Locals("ip", c.IP())
 
 	// Extract session ID (expect format: "Bearer <session_id>")
 	sessionID := ""
@@ -312,33 +565,86 @@ func AuthMiddleware(c *fiber.Ctx) error {
 		sessionID = authHeader
 	}
 
-	if !ValidateSession(sessionID) {
+	// API tokens authenticate like sessions; Require checks their scopes
+	if strings.HasPrefix(sessionID, apitoken.Prefix) {
+		token, valid := ValidateAPIToken(sessionID)
+		if !valid {
+			auditDenied(c, "auth.token", "Invalid or expired API token")
+			return c.Status(401).JSON(fiber.Map{
+				"error": "Invalid or expired API token",
+			})
+		}
+		c.Locals("user", "token:"+token.Name)
+		c.Locals("token", token)
+		return c.Next()
+	}
+
+	user, valid := ValidateSession(sessionID)
+	if !valid {
+		auditDenied(c, "auth.session", "Invalid or expired session")
 		return c.Status(401).JSON(fiber.Map{
 			"error": "Invalid or expired session",
 		})
 	}
 
+	c.Locals("user", user.Name)
+	c.Locals("role", user.Role)
+	c.Locals("session", sessionID)
 	return c.Next()
 }
 
+// Require lets users with at least the given role through, and API tokens
+// with the scope. Routes without a scope are for users only. It runs after
+// AuthMiddleware.
+func Require(role users.Role, scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if token, ok := c.Locals("token").(apitoken.Token); ok {
+			if scope == "" {
+				return c.Status(403).JSON(fiber.Map{
+					"error": "This action is not available to API tokens",
+				})
+			}
+			if !token.Allows(scope) {
+				return c.Status(403).JSON(fiber.Map{
+					"error": fmt.Sprintf("This action requires the %s scope", scope),
+				})
+			}
+			return c.Next()
+		}
+
+		if userRole, _ := c.Locals("role").(users.Role); !userRole.Allows(role) {
+			return c.Status(403).JSON(fiber.Map{
+				"error": fmt.Sprintf("This action requires the %s role", role),
+			})
+		}
+		return c.Next()
+	}
+}
+
+// currentUser returns the name of the user making the request.
+func currentUser(c *fiber.Ctx) string {
+	name, _ := c.Locals("user").(string)
+	return name
+}
+
 // GetAuthStatus returns current authentication status
 func GetAuthStatus(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{
-		"totp_enabled":    totpSecret != "",
+		"totp_enabled":    userStore.Count() > 0,
 		"config_path":     configDir,
-		"active_sessions": len(sessions),
-		"secret_loaded":   totpSecret != "",
+		"active_sessions": sessions.Count(),
+		"secret_loaded":   userStore.Count() > 0,
+		"users":           userStore.Count(),
+		"lockout":         authLimiter.status(c.IP()),
 	})
 }
 
-// RegenerateTOTP regenerates TOTP secret (requires existing authentication)
+// RegenerateTOTP gives the current user a new TOTP secret to enroll. It only
+// replaces the current one once ConfirmTOTP receives a code from it; until
+// then the current secret keeps working.
 func RegenerateTOTP(c *fiber.Ctx) error {
-	// Remove old config
-	os.Remove(secretFile)
-	os.Remove(filepath.Join(configDir, "totp_qr.png"))
-
-	// Generate new secret
-	err := generateNewTOTPSecret()
+	name := currentUser(c)
+	results, err := startTOTPRotation(name)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error":   "Failed to regenerate TOTP",
@@ -346,13 +652,140 @@ func RegenerateTOTP(c *fiber.Ctx) error {
 		})
 	}
 
-	// Clear all existing sessions
-	sessions = make(map[string]*Session)
+	log.Printf("🔐 New TOTP secret of %s waiting for confirmation", name)
+	results["success"] = true
+	results["pending"] = true
+	results["message"] = "Scan the QR code, then confirm with a code from the new secret. Your current secret stays active until then."
+	return c.JSON(results)
+}
 
+// ConfirmTOTP switches the current user to the secret from RegenerateTOTP,
+// given a code from it, and logs them out of all their sessions
+func ConfirmTOTP(c *fiber.Ctx) error {
+	var req AuthRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON body"})
+	}
+	if req.TOTPCode == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "TOTP code is required"})
+	}
+
+	name := currentUser(c)
+	valid, err := confirmTOTPRotation(name, req.TOTPCode, time.Now())
+	if errors.Is(err, errNoRotation) {
+		return c.Status(409).JSON(fiber.Map{
+			"success": false,
+			"message": "No new TOTP secret to confirm. Regenerate one first.",
+		})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"success": false, "message": err.Error()})
+	}
+	if !valid {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid TOTP code from the new secret. Your current secret is still active.",
+		})
+	}
+
+	if err := sessions.DeleteUser(name); err != nil {
+		log.Println("Failed to clear sessions:", err)
+	}
+	log.Printf("🔐 TOTP secret of %s regenerated", name)
 	return c.JSON(fiber.Map{
 		"success": true,
-		"message": "TOTP secret regenerated successfully. All sessions have been invalidated.",
+		"message": "TOTP secret replaced. All your sessions have been invalidated, authenticate with the new secret.",
+	})
+}
+
+var errNoRotation = errors.New("no new TOTP secret to confirm")
+
+// startTOTPRotation gives a user a new secret to confirm, replacing one
+// that is already waiting. It returns the enrollment of the new secret.
+func startTOTPRotation(name string) (map[string]any, error) {
+	user, exists := userStore.Get(name)
+	if !exists {
+		return nil, users.ErrNotFound
+	}
+	fresh, key, err := newTOTPUser(user.Name, user.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	totpMu.Lock()
+	_, err = userStore.Update(name, func(u *users.User) {
+		u.Rotation = &users.Rotation{
+			Secret:      fresh.Secret,
+			AccountName: fresh.AccountName,
+			Issuer:      fresh.Issuer,
+			CreatedAt:   fresh.CreatedAt,
+		}
+	})
+	totpMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return enrollment(fresh, key.URL())
+}
+
+// confirmTOTPRotation makes a user's new secret the current one if code is
+// valid for it. The code's step counts as used, so it can't log in again.
+func confirmTOTPRotation(name, code string, now time.Time) (bool, error) {
+	totpMu.Lock()
+	defer totpMu.Unlock()
+
+	user, exists := userStore.Get(name)
+	if !exists {
+		return false, users.ErrNotFound
+	}
+	if user.Rotation == nil {
+		return false, errNoRotation
+	}
+	rotation := *user.Rotation
+	step, valid := codeStep(rotation.Secret, code, now)
+	if !valid {
+		return false, nil
+	}
+
+	_, err := userStore.Update(name, func(u *users.User) {
+		u.Secret = rotation.Secret
+		u.AccountName = rotation.AccountName
+		u.Issuer = rotation.Issuer
+		u.LastUsedStep = step
+		u.Rotation = nil
 	})
+	return err == nil, err
+}
+
+// resetTOTP replaces a user's secret right away and ends their sessions,
+// for users who lost their authenticator. It returns the new enrollment.
+func resetTOTP(name string) (map[string]any, error) {
+	user, exists := userStore.Get(name)
+	if !exists {
+		return nil, users.ErrNotFound
+	}
+	fresh, key, err := newTOTPUser(user.Name, user.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	totpMu.Lock()
+	user, err = userStore.Update(name, func(u *users.User) {
+		u.Secret = fresh.Secret
+		u.AccountName = fresh.AccountName
+		u.Issuer = fresh.Issuer
+		u.LastUsedStep = 0
+		u.Rotation = nil
+	})
+	totpMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sessions.DeleteUser(name); err != nil {
+		log.Println("Failed to clear sessions:", err)
+	}
+	return enrollment(user, key.URL())
 }
 
 // GetSessionStatus returns information about the current session
@@ -371,7 +804,7 @@ func GetSessionStatus(c *fiber.Ctx) error {
 		sessionID = authHeader
 	}
 
-	session, exists := sessions[sessionID]
+	session, exists := sessions.Get(sessionID)
 	if !exists {
 		return c.Status(401).JSON(fiber.Map{
 			"error": "Session not found",
@@ -379,7 +812,6 @@ func GetSessionStatus(c *fiber.Ctx) error {
 	}
 
 	if time.Now().After(session.ExpiresAt) {
-		delete(sessions, sessionID)
 		return c.Status(401).JSON(fiber.Map{
 			"error": "Session expired",
 		})
@@ -387,14 +819,24 @@ func GetSessionStatus(c *fiber.Ctx) error {
 
 	timeRemaining := time.Until(session.ExpiresAt)
 
-	return c.JSON(fiber.Map{
+	resp := fiber.Map{
 		"valid":          true,
 		"session_id":     sessionID[:16] + "...", // Only show first 16 chars for security
 		"created_at":     session.CreatedAt.Format(time.RFC3339),
+		"user":           session.User,
+		"role":           c.Locals("role"),
 		"expires_at":     session.ExpiresAt.Format(time.RFC3339),
 		"time_remaining": timeRemaining.String(),
 		"expires_in_sec": int(timeRemaining.Seconds()),
-	})
+		"idle_timeout":   sessionValid.String(),
+	}
+	if !session.MaxExpiresAt.IsZero() {
+		resp["max_expires_at"] = session.MaxExpiresAt.Format(time.RFC3339)
+	}
+	if user, exists := userStore.Get(session.User); exists {
+		resp["totp_rotation_pending"] = user.Rotation != nil
+	}
+	return c.JSON(resp)
 }
 
 // LogoutHandler invalidates a session
@@ -413,7 +855,9 @@ func LogoutHandler(c *fiber.Ctx) error {
 		sessionID = authHeader
 	}
 
-	delete(sessions, sessionID)
+	if err := sessions.Delete(sessionID); err != nil {
+		log.Println("Failed to delete session:", err)
+	}
 
 	return c.JSON(fiber.Map{
 		"success": true,
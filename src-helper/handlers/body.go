@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"strconv"
+
+	"piControlHelper/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// uploadPath is the one route that takes bodies larger than the default
+// limit. Its handler reads the upload from the connection itself.
+const uploadPath = "/api/install/file"
+
+var maxUploadSize = config.Default().MaxUploadSize
+
+// InitializeUploads sets the size limit of package file uploads
+func InitializeUploads(maxSize int) {
+	maxUploadSize = maxSize
+}
+
+// LimitBody rejects request bodies over limit on every route but uploads.
+// The app streams request bodies so uploads aren't held in memory, which
+// also means Fiber no longer enforces its body limit itself: reading the
+// body of a streamed request would pull all of it into memory.
+func LimitBody(limit int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Path() == uploadPath {
+			// A refused upload is left unread on the connection
+			c.Set(fiber.HeaderConnection, "close")
+			return c.Next()
+		}
+		if status, message := checkBodySize(c, limit); status != 0 {
+			c.Set(fiber.HeaderConnection, "close")
+			return c.Status(status).JSON(fiber.Map{"error": message})
+		}
+		return c.Next()
+	}
+}
+
+// checkBodySize returns the status and message to refuse a request with if
+// its body is larger than limit, or 0. Chunked and compressed bodies are
+// refused, since their size isn't known up front.
+func checkBodySize(c *fiber.Ctx, limit int) (int, string) {
+	switch n := c.Request().Header.ContentLength(); {
+	case len(c.Request().Header.ContentEncoding()) > 0:
+		return fiber.StatusUnsupportedMediaType, "Compressed request bodies are not supported"
+	case n == -1:
+		return fiber.StatusLengthRequired, "Content-Length required"
+	case n > limit:
+		return fiber.StatusRequestEntityTooLarge, "Request body exceeds " + strconv.Itoa(limit) + " bytes"
+	}
+	return 0, ""
+}
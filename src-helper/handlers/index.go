@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"piControlHelper/pkgindex"
+	"piControlHelper/pkgmgr"
+	"piControlHelper/utils"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var packageIndex *pkgindex.Index
+
+// InitializeIndex builds the search index from the local package lists and
+// refreshes lists and index every interval. Installs refresh the lists
+// themselves once they are older than maxAge.
+func InitializeIndex(interval, maxAge time.Duration) {
+	packageIndex = pkgindex.New(maxAge)
+
+	go func() {
+		distro := utils.IdentifyDistro()
+		pm, err := newPackageManager(distro)
+		if err != nil {
+			log.Println("Package index disabled:", err)
+			return
+		}
+
+		unlock := jobManager.Lock(packagesResource)
+		if err := packageIndex.Rebuild(pm); err != nil {
+			log.Println("Failed to build package index:", err)
+		}
+		unlock()
+
+		// A zero interval disables scheduled refreshes
+		if interval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			unlock := jobManager.Lock(packagesResource)
+			if err := refreshIndex(pm, true); err != nil {
+				log.Println("Scheduled package index refresh failed:", err)
+			}
+			unlock()
+		}
+	}()
+}
+
+// refreshIndex refreshes the package lists through pm, when forced or stale,
+// and rebuilds the index. The rebuild always uses a plain runner: a full
+// package listing would swamp a job's output. The caller holds the package
+// manager lock.
+func refreshIndex(pm pkgmgr.PackageManager, force bool) error {
+	var listsErr error
+	if force {
+		listsErr = packageIndex.RefreshLists(pm)
+	} else {
+		listsErr = packageIndex.RefreshListsIfStale(pm)
+	}
+
+	lister, err := newPackageManager(utils.IdentifyDistro())
+	if err != nil {
+		return errors.Join(listsErr, err)
+	}
+	return errors.Join(listsErr, packageIndex.Rebuild(lister))
+}
+
+// IndexStatus reports the state of the package search index
+func IndexStatus(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"distribution": utils.IdentifyDistro(), "success": true, "index": packageIndex.Status()})
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"fmt"
+	"piControlHelper/jobs"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// packagesResource serializes everything that takes the package manager lock
+// (dpkg, rpm, pacman db), whether it runs as a job or inline.
+const packagesResource = "packages"
+
+var jobManager *jobs.Manager
+
+// InitializeJobs starts the background job manager
+func InitializeJobs(retention time.Duration) {
+	jobManager = jobs.NewManager(retention)
+}
+
+// serviceResource serializes actions on a single unit.
+func serviceResource(service string) string {
+	return "service:" + service
+}
+
+// jobAccepted is the response for any request that was queued as a job.
+func jobAccepted(c *fiber.Ctx, job *jobs.Job) error {
+	snap := job.Snapshot()
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"success": true,
+		"job_id":  snap.ID,
+		"status":  snap.Status,
+	})
+}
+
+// failedPackages turns per-package results into a job error.
+func failedPackages(results []PackageResult) error {
+	failed := 0
+	for _, result := range results {
+		if !result.Success {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d packages failed", failed, len(results))
+	}
+	return nil
+}
+
+// ListJobs returns every job that is queued, running or still retained
+func ListJobs(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"success": true, "jobs": jobManager.List()})
+}
+
+// GetJob returns status, output and exit code of a single job
+func GetJob(c *fiber.Ctx) error {
+	job, ok := jobManager.Get(c.Params("id"))
+	if !ok {
+		return c.Status(404).JSON(fiber.Map{"error": "Job not found"})
+	}
+	return c.JSON(job.Snapshot())
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"piControlHelper/config"
+)
+
+// clientFailureMemory is how long a client's wrong codes count against it.
+const clientFailureMemory = 24 * time.Hour
+
+var authLimiter = newLoginLimiter(config.Default().AuthLockout)
+
+// InitializeAuthLimiter applies the configured lockout settings
+func InitializeAuthLimiter(settings config.AuthLockout) {
+	authLimiter = newLoginLimiter(settings)
+}
+
+// LockoutStatus describes the lockout of one client and of /auth as a whole.
+type LockoutStatus struct {
+	Locked        bool `json:"locked"`
+	RetryAfterSec int  `json:"retry_after_sec"`
+	// Failures counts the client's wrong codes since its last success.
+	Failures            int  `json:"failures"`
+	GlobalLocked        bool `json:"global_locked"`
+	GlobalRetryAfterSec int  `json:"global_retry_after_sec"`
+	// GlobalFailures counts wrong codes from all clients in the window.
+	GlobalFailures int `json:"global_failures"`
+	LockedClients  int `json:"locked_clients"`
+}
+
+// loginLimiter slows down TOTP guessing. Each client gets a few free
+// attempts, then a lockout that doubles with every further wrong code. On
+// top of that, too many wrong codes from all clients together lock /auth
+// for everyone until they age out of the window, which stops guessing
+// spread over many addresses.
+type loginLimiter struct {
+	settings config.AuthLockout
+
+	mu      sync.Mutex
+	clients map[string]*clientFailures
+	// global holds the times of recent wrong codes, oldest first
+	global []time.Time
+}
+
+type clientFailures struct {
+	failures    int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+func newLoginLimiter(settings config.AuthLockout) *loginLimiter {
+	return &loginLimiter{settings: settings, clients: map[string]*clientFailures{}}
+}
+
+// begin starts a login attempt. If the client may try, the attempt is
+// counted as a wrong code right away, in the same critical section as the
+// lockout check, so concurrent guesses can't all get in before the first
+// one fails. It returns how long the client has to wait instead, and the
+// time the attempt was counted at, for succeed.
+func (l *loginLimiter) begin(ip string) (time.Duration, time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if wait := max(l.clientWait(ip, now), l.globalWait(now)); wait > 0 {
+		return wait, now
+	}
+	l.fail(ip, now)
+	return 0, now
+}
+
+// fail records a wrong code. The caller holds l.mu.
+func (l *loginLimiter) fail(ip string, now time.Time) {
+	l.prune(now)
+
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &clientFailures{}
+		l.clients[ip] = client
+	}
+	client.failures++
+	client.last = now
+	if excess := client.failures - l.settings.MaxFailures; excess >= 0 {
+		lockout := time.Duration(l.settings.MaxLockout)
+		if excess < 32 {
+			lockout = min(time.Duration(l.settings.Lockout)<<excess, lockout)
+		}
+		client.lockedUntil = now.Add(lockout)
+	}
+
+	l.global = append(l.global, now)
+}
+
+// succeed takes back the attempt begun at, which had a valid code, and
+// forgets the client's wrong codes.
+func (l *loginLimiter) succeed(ip string, at time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.clients, ip)
+	for i := len(l.global) - 1; i >= 0; i-- {
+		if l.global[i].Equal(at) {
+			l.global = append(l.global[:i], l.global[i+1:]...)
+			break
+		}
+	}
+}
+
+func (l *loginLimiter) status(ip string) LockoutStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.prune(now)
+
+	status := LockoutStatus{GlobalFailures: len(l.global)}
+	if wait := l.clientWait(ip, now); wait > 0 {
+		status.Locked = true
+		status.RetryAfterSec = retryAfter(wait)
+	}
+	if client, ok := l.clients[ip]; ok {
+		status.Failures = client.failures
+	}
+	if wait := l.globalWait(now); wait > 0 {
+		status.GlobalLocked = true
+		status.GlobalRetryAfterSec = retryAfter(wait)
+	}
+	for _, client := range l.clients {
+		if now.Before(client.lockedUntil) {
+			status.LockedClients++
+		}
+	}
+	return status
+}
+
+func (l *loginLimiter) clientWait(ip string, now time.Time) time.Duration {
+	if client, ok := l.clients[ip]; ok && now.Before(client.lockedUntil) {
+		return client.lockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// globalWait returns how long until enough wrong codes leave the window to
+// drop below the global limit.
+func (l *loginLimiter) globalWait(now time.Time) time.Duration {
+	window := time.Duration(l.settings.GlobalWindow)
+	limit := l.settings.GlobalMaxFailures
+	if limit <= 0 || len(l.global) < limit {
+		return 0
+	}
+	return max(l.global[len(l.global)-limit].Add(window).Sub(now), 0)
+}
+
+// prune drops wrong codes that no longer count.
+func (l *loginLimiter) prune(now time.Time) {
+	window := time.Duration(l.settings.GlobalWindow)
+	i := 0
+	for i < len(l.global) && now.Sub(l.global[i]) > window {
+		i++
+	}
+	l.global = l.global[i:]
+
+	for ip, client := range l.clients {
+		if now.Sub(client.last) > clientFailureMemory && now.After(client.lockedUntil) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// retryAfter rounds a wait up to whole seconds, for Retry-After.
+func retryAfter(wait time.Duration) int {
+	return int((wait + time.Second - 1) / time.Second)
+}
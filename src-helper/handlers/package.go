@@ -1,10 +1,16 @@
 package handlers
 
 import (
-	"bufio"
+	"encoding/json"
+	"errors"
 	"log"
 	"maps"
+	"os"
+	"path/filepath"
+	"piControlHelper/jobs"
+	"piControlHelper/pkgmgr"
 	"piControlHelper/utils"
+	"slices"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
@@ -12,23 +18,132 @@ import (
 
 type PackageResult struct {
 	Package string `json:"package"`
+	Version string `json:"version,omitempty"`
+	Source  string `json:"source,omitempty"`
 	Success bool   `json:"success"`
 	Message string `json:"message"`
 }
 
-type SearchResult struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
+// nativeSource marks packages handled by the distribution's package manager,
+// as opposed to an app source like flatpak or snap.
+const nativeSource = "native"
+
+// PackageRequest is an entry of an install or uninstall request's
+// "packages": either a bare name or an object that pins a version or picks
+// an app source, e.g. {"name": "org.mozilla.firefox", "source": "flatpak"}.
+type PackageRequest struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Source  string `json:"source"`
 }
 
+func (p *PackageRequest) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &p.Name); err == nil {
+		return nil
+	}
+	type plain PackageRequest
+	return json.Unmarshal(data, (*plain)(p))
+}
+
+// target is the argument passed to the package manager.
+func (p PackageRequest) target(pm pkgmgr.PackageManager) string {
+	if p.Version == "" {
+		return p.Name
+	}
+	return pm.Versioned(p.Name, p.Version)
+}
+
+func (p PackageRequest) native() bool {
+	return p.Source == "" || p.Source == nativeSource
+}
+
+// result starts a PackageResult for p, naming its source unless it's native.
+func (p PackageRequest) result() PackageResult {
+	result := PackageResult{Package: p.Name, Version: p.Version}
+	if !p.native() {
+		result.Source = p.Source
+	}
+	return result
+}
+
+// checkPackageRequests validates names and sources before anything runs.
+func checkPackageRequests(packages []PackageRequest, sources map[string]pkgmgr.AppSource) string {
+	for _, pkg := range packages {
+		if pkg.Name == "" {
+			return "Package name required"
+		}
+		if looksLikeOption(pkg.Name) {
+			return "Invalid package name: " + pkg.Name
+		}
+		if looksLikeOption(pkg.Version) {
+			return "Invalid version: " + pkg.Version
+		}
+		if pkg.native() {
+			continue
+		}
+		if _, ok := sources[pkg.Source]; !ok {
+			return "Package source not available: " + pkg.Source
+		}
+		if pkg.Version != "" {
+			return "Versions can only be given for native packages"
+		}
+	}
+	return ""
+}
+
+// looksLikeOption reports whether a name would reach the package manager as
+// an option rather than a package, e.g. "-oDpkg::Pre-Invoke::=...".
+func looksLikeOption(name string) bool {
+	return strings.HasPrefix(name, "-")
+}
+
+// checkPackageNames is checkPackageRequests for plain lists of names.
+func checkPackageNames(packages []string) string {
+	for _, pkg := range packages {
+		if pkg == "" {
+			return "Package name required"
+		}
+		if looksLikeOption(pkg) {
+			return "Invalid package name: " + pkg
+		}
+	}
+	return ""
+}
+
+func allNative(packages []PackageRequest) bool {
+	for _, pkg := range packages {
+		if !pkg.native() {
+			return false
+		}
+	}
+	return true
+}
+
+func packageTargets(pm pkgmgr.PackageManager, packages []PackageRequest) []string {
+	targets := make([]string, len(packages))
+	for i, pkg := range packages {
+		targets[i] = pkg.target(pm)
+	}
+	return targets
+}
+
+// newPackageManager resolves the backend for a distribution.
+var newPackageManager = pkgmgr.New
+
+// newAppSources returns the flatpak/snap sources installed on this system.
+var newAppSources = pkgmgr.Sources
+
 func InstallPackages(c *fiber.Ctx) error {
 	distro := utils.IdentifyDistro()
-	if distro == "unknown" {
+	pm, err := newPackageManager(distro)
+	if err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Unsupported distribution"})
 	}
 
 	var body struct {
-		Packages []string `json:"packages"`
+		Packages []PackageRequest `json:"packages"`
+		Async    bool             `json:"async"`
+		DryRun   bool             `json:"dry_run"`
 	}
 	if err := c.BodyParser(&body); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Request must be JSON"})
@@ -37,42 +152,170 @@ func InstallPackages(c *fiber.Ctx) error {
 	if len(body.Packages) == 0 {
 		return c.Status(400).JSON(fiber.Map{"error": "No packages specified"})
 	}
+	sources := newAppSources()
+	if message := checkPackageRequests(body.Packages, sources); message != "" {
+		return c.Status(400).JSON(fiber.Map{"error": message})
+	}
+
+	if body.DryRun {
+		if !allNative(body.Packages) {
+			return c.Status(400).JSON(fiber.Map{"error": "Dry run is only supported for native packages"})
+		}
+		defer jobManager.Lock(packagesResource)()
+		results, _ := simulate(pm.SimulateInstall, packageTargets(pm, body.Packages))
+		resp := fiber.Map{"distribution": distro, "dry_run": true}
+		maps.Copy(resp, results)
+		return c.JSON(resp)
+	}
 
-	results := installPackages(body.Packages, distro)
+	if body.Async {
+		job := jobManager.Submit("install", packagesResource, func(j *jobs.Job) (any, error) {
+			pm, _ := pkgmgr.NewWithRunner(distro, j.RunCommand)
+			results := installPackages(pm, pkgmgr.SourcesWithRunner(j.RunCommand), body.Packages)
+			return fiber.Map{"distribution": distro, "results": results}, failedPackages(results)
+		})
+		return jobAccepted(c, job)
+	}
+
+	defer jobManager.Lock(packagesResource)()
+	results := installPackages(pm, sources, body.Packages)
 	return c.JSON(fiber.Map{"distribution": distro, "results": results})
 }
 
-func installPackages(packages []string, distro string) []PackageResult {
+func installPackages(pm pkgmgr.PackageManager, sources map[string]pkgmgr.AppSource, packages []PackageRequest) []PackageResult {
 	var results []PackageResult
 	if len(packages) == 0 {
 		return []PackageResult{{Package: "", Success: false, Message: "No packages specified"}}
 	}
 
-	// On debian, update first
-	if distro == "debian" {
-		_, stderr, err := utils.RunCommand("sudo", "apt-get", "update")
+	if err := packageIndex.RefreshListsIfStale(pm); err != nil {
+		log.Println("Failed to update package lists:", err)
+	}
+
+	for _, pkg := range packages {
+		result := pkg.result()
+		out, err := installPackage(pm, sources, pkg)
 		if err != nil {
-			log.Println("Failed to update package lists:", stderr)
+			result.Message = err.Error()
+			log.Printf("Failed to install %s: %v", pkg.Name, err)
+		} else {
+			result.Success, result.Message = true, out
 		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// installPackage installs a single package from its source. The request must
+// have passed checkPackageRequests.
+func installPackage(pm pkgmgr.PackageManager, sources map[string]pkgmgr.AppSource, pkg PackageRequest) (string, error) {
+	if pkg.native() {
+		return pm.Install(pkg.target(pm))
 	}
+	return sources[pkg.Source].Install(pkg.Name)
+}
 
-	for _, pkg := range packages {
-		var cmd []string
-		switch distro {
-		case "fedora":
-			cmd = []string{"sudo", "dnf", "install", "-y", pkg}
-		case "arch":
-			cmd = []string{"sudo", "pacman", "-S", "--noconfirm", pkg}
-		case "debian":
-			cmd = []string{"sudo", "apt-get", "install", "-y", pkg}
+func removePackage(pm pkgmgr.PackageManager, sources map[string]pkgmgr.AppSource, pkg PackageRequest) (string, error) {
+	if pkg.native() {
+		return pm.Remove(pkg.Name)
+	}
+	return sources[pkg.Source].Remove(pkg.Name)
+}
+
+// InstallPackageFiles installs uploaded package files (.deb, .rpm,
+// .pkg.tar.zst, .apk) with the distribution's package manager. Dependencies
+// are still resolved from the configured repositories.
+func InstallPackageFiles(c *fiber.Ctx) error {
+	if status, message := checkBodySize(c, maxUploadSize); status != 0 {
+		return c.Status(status).JSON(fiber.Map{"error": message})
+	}
+
+	distro := utils.IdentifyDistro()
+	pm, err := newPackageManager(distro)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Unsupported distribution"})
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Request must be multipart/form-data"})
+	}
+	files := form.File["file"]
+	if len(files) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "No package files uploaded"})
+	}
+
+	// Keep the original names: the package managers pick the format from
+	// the extension.
+	dir, err := os.MkdirTemp("", "picontrol-upload-*")
+	if err != nil {
+		log.Println("Failed to create upload directory:", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store uploaded files"})
+	}
+	var paths []string
+	for _, file := range files {
+		name := filepath.Base(file.Filename)
+		if !isPackageFileName(name) || slices.Contains(paths, filepath.Join(dir, name)) {
+			os.RemoveAll(dir)
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid or duplicate file name: " + file.Filename})
+		}
+		path := filepath.Join(dir, name)
+		if err := c.SaveFile(file, path); err != nil {
+			os.RemoveAll(dir)
+			log.Println("Failed to save uploaded file:", err)
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to store uploaded files"})
 		}
+		paths = append(paths, path)
+	}
+
+	if c.FormValue("async") == "true" {
+		job := jobManager.Submit("install_file", packagesResource, func(j *jobs.Job) (any, error) {
+			defer os.RemoveAll(dir)
+			pm, _ := pkgmgr.NewWithRunner(distro, j.RunCommand)
+			results := installPackageFiles(pm, paths)
+			return fiber.Map{"distribution": distro, "results": results}, failedPackages(results)
+		})
+		return jobAccepted(c, job)
+	}
+
+	defer os.RemoveAll(dir)
+	defer jobManager.Lock(packagesResource)()
+	results := installPackageFiles(pm, paths)
+	return c.JSON(fiber.Map{"distribution": distro, "results": results})
+}
+
+// packageFileExtensions are the formats InstallPackageFiles accepts. Each
+// backend checks again that the format is its own.
+var packageFileExtensions = []string{".deb", ".rpm", ".pkg.tar.zst", ".pkg.tar.xz", ".pkg.tar.gz", ".apk"}
+
+// isPackageFileName reports whether an uploaded file's base name can be
+// stored as is: not "." or "..", and ending in a package extension.
+func isPackageFileName(name string) bool {
+	if name == "." || name == ".." {
+		return false
+	}
+	for _, ext := range packageFileExtensions {
+		if len(name) > len(ext) && strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func installPackageFiles(pm pkgmgr.PackageManager, paths []string) []PackageResult {
+	if err := packageIndex.RefreshListsIfStale(pm); err != nil {
+		log.Println("Failed to update package lists:", err)
+	}
 
-		out, errout, err := utils.RunCommand(cmd[0], cmd[1:]...)
+	var results []PackageResult
+	for _, path := range paths {
+		name := filepath.Base(path)
+		out, err := pm.InstallFile(path)
 		if err != nil {
-			results = append(results, PackageResult{Package: pkg, Success: false, Message: errout})
-			log.Printf("Failed to install %s: %v\n%s", pkg, err, errout)
+			results = append(results, PackageResult{Package: name, Success: false, Message: err.Error()})
+			log.Printf("Failed to install %s: %v", name, err)
 		} else {
-			results = append(results, PackageResult{Package: pkg, Success: true, Message: out})
+			results = append(results, PackageResult{Package: name, Success: true, Message: out})
 		}
 	}
 	return results
@@ -80,12 +323,15 @@ func installPackages(packages []string, distro string) []PackageResult {
 
 func UninstallPackages(c *fiber.Ctx) error {
 	distro := utils.IdentifyDistro()
-	if distro == "unknown" {
+	pm, err := newPackageManager(distro)
+	if err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Unsupported distribution"})
 	}
 
 	var body struct {
-		Packages []string `json:"packages"`
+		Packages []PackageRequest `json:"packages"`
+		Async    bool             `json:"async"`
+		DryRun   bool             `json:"dry_run"`
 	}
 	if err := c.BodyParser(&body); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Request must be JSON"})
@@ -94,32 +340,111 @@ func UninstallPackages(c *fiber.Ctx) error {
 	if len(body.Packages) == 0 {
 		return c.Status(400).JSON(fiber.Map{"error": "No packages specified"})
 	}
+	sources := newAppSources()
+	if message := checkPackageRequests(body.Packages, sources); message != "" {
+		return c.Status(400).JSON(fiber.Map{"error": message})
+	}
 
-	results := uninstallPackages(body.Packages, distro)
+	if body.DryRun {
+		if !allNative(body.Packages) {
+			return c.Status(400).JSON(fiber.Map{"error": "Dry run is only supported for native packages"})
+		}
+		names := make([]string, len(body.Packages))
+		for i, pkg := range body.Packages {
+			names[i] = pkg.Name
+		}
+		defer jobManager.Lock(packagesResource)()
+		results, _ := simulate(pm.SimulateRemove, names)
+		resp := fiber.Map{"distribution": distro, "dry_run": true}
+		maps.Copy(resp, results)
+		return c.JSON(resp)
+	}
+
+	if body.Async {
+		job := jobManager.Submit("uninstall", packagesResource, func(j *jobs.Job) (any, error) {
+			pm, _ := pkgmgr.NewWithRunner(distro, j.RunCommand)
+			results := uninstallPackages(pm, pkgmgr.SourcesWithRunner(j.RunCommand), body.Packages)
+			return fiber.Map{"distribution": distro, "results": results}, failedPackages(results)
+		})
+		return jobAccepted(c, job)
+	}
+
+	defer jobManager.Lock(packagesResource)()
+	results := uninstallPackages(pm, sources, body.Packages)
 	return c.JSON(fiber.Map{"distribution": distro, "results": results})
 }
 
-func uninstallPackages(packages []string, distro string) []PackageResult {
+func uninstallPackages(pm pkgmgr.PackageManager, sources map[string]pkgmgr.AppSource, packages []PackageRequest) []PackageResult {
 	var results []PackageResult
 	if len(packages) == 0 {
 		return []PackageResult{{Package: "", Success: false, Message: "No packages specified"}}
 	}
 
 	for _, pkg := range packages {
-		var cmd []string
-		switch distro {
-		case "fedora":
-			cmd = []string{"sudo", "dnf", "remove", "-y", pkg}
-		case "arch":
-			cmd = []string{"sudo", "pacman", "-R", "--noconfirm", pkg}
-		case "debian":
-			cmd = []string{"sudo", "apt-get", "remove", "-y", pkg}
+		result := pkg.result()
+		out, err := removePackage(pm, sources, pkg)
+		if err != nil {
+			result.Message = err.Error()
+			log.Printf("Failed to uninstall %s: %v", pkg.Name, err)
+		} else {
+			result.Success, result.Message = true, out
 		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// HoldPackages keeps packages at their installed version during upgrades
+func HoldPackages(c *fiber.Ctx) error {
+	return setHeld(c, true)
+}
+
+// UnholdPackages lets held packages be upgraded again
+func UnholdPackages(c *fiber.Ctx) error {
+	return setHeld(c, false)
+}
+
+func setHeld(c *fiber.Ctx, hold bool) error {
+	distro := utils.IdentifyDistro()
+	holder, ok := packageHolder(distro)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "Package holds are not supported on this distribution"})
+	}
+	if err := pkgmgr.CheckHolds(holder); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
 
-		out, errout, err := utils.RunCommand(cmd[0], cmd[1:]...)
+	var body struct {
+		Packages []string `json:"packages"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Request must be JSON"})
+	}
+
+	if len(body.Packages) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "No packages specified"})
+	}
+	if message := checkPackageNames(body.Packages); message != "" {
+		return c.Status(400).JSON(fiber.Map{"error": message})
+	}
+
+	defer jobManager.Lock(packagesResource)()
+	results := holdPackages(holder, body.Packages, hold)
+	return c.JSON(fiber.Map{"distribution": distro, "results": results})
+}
+
+func holdPackages(holder pkgmgr.Holder, packages []string, hold bool) []PackageResult {
+	action, apply := "unhold", holder.Unhold
+	if hold {
+		action, apply = "hold", holder.Hold
+	}
+
+	var results []PackageResult
+	for _, pkg := range packages {
+		out, err := apply(pkg)
 		if err != nil {
-			results = append(results, PackageResult{Package: pkg, Success: false, Message: errout})
-			log.Printf("Failed to uninstall %s: %v\n%s", pkg, err, errout)
+			results = append(results, PackageResult{Package: pkg, Success: false, Message: err.Error()})
+			log.Printf("Failed to %s %s: %v", action, pkg, err)
 		} else {
 			results = append(results, PackageResult{Package: pkg, Success: true, Message: out})
 		}
@@ -127,149 +452,285 @@ func uninstallPackages(packages []string, distro string) []PackageResult {
 	return results
 }
 
+// ListHeldPackages lists packages that are held back from upgrades
+func ListHeldPackages(c *fiber.Ctx) error {
+	distro := utils.IdentifyDistro()
+	holder, ok := packageHolder(distro)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "Package holds are not supported on this distribution"})
+	}
+	if err := pkgmgr.CheckHolds(holder); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	held, err := holder.ListHeld()
+	if err != nil {
+		log.Println("Failed to list held packages:", err)
+		return c.JSON(fiber.Map{"distribution": distro, "success": false, "message": err.Error()})
+	}
+	return c.JSON(fiber.Map{"distribution": distro, "success": true, "packages": held})
+}
+
+// packageHolder returns the distro's backend if it supports holds.
+func packageHolder(distro string) (pkgmgr.Holder, bool) {
+	pm, err := newPackageManager(distro)
+	if err != nil {
+		return nil, false
+	}
+	holder, ok := pm.(pkgmgr.Holder)
+	return holder, ok
+}
+
+// simulate resolves a transaction without applying it, so the caller can see
+// which packages would be installed, upgraded or removed.
+func simulate(resolve func(...string) (*pkgmgr.Transaction, error), packages []string) (map[string]any, error) {
+	tx, err := resolve(packages...)
+	if err != nil {
+		log.Printf("Failed to simulate transaction for %v: %v", packages, err)
+		return fiber.Map{"success": false, "message": err.Error()}, nil
+	}
+
+	return fiber.Map{"success": true, "transaction": tx}, nil
+}
+
+// RefreshPackageLists updates the package lists (e.g. apt-get update) and
+// rebuilds the search index
+func RefreshPackageLists(c *fiber.Ctx) error {
+	distro := utils.IdentifyDistro()
+	pm, err := newPackageManager(distro)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Unsupported distribution"})
+	}
+
+	var body struct {
+		Async bool `json:"async"`
+	}
+	// An empty body means a synchronous refresh
+	_ = c.BodyParser(&body)
+
+	if body.Async {
+		job := jobManager.Submit("refresh", packagesResource, func(j *jobs.Job) (any, error) {
+			pm, _ := pkgmgr.NewWithRunner(distro, j.RunCommand)
+			err := refreshIndex(pm, true)
+			return fiber.Map{"index": packageIndex.Status()}, err
+		})
+		return jobAccepted(c, job)
+	}
+
+	defer jobManager.Lock(packagesResource)()
+	if err := refreshIndex(pm, true); err != nil {
+		log.Println("Failed to update package lists:", err)
+		return c.JSON(fiber.Map{"distribution": distro, "success": false, "message": err.Error(), "index": packageIndex.Status()})
+	}
+	return c.JSON(fiber.Map{"distribution": distro, "success": true, "index": packageIndex.Status()})
+}
+
+// ListUpdates lists upgradable packages with current and candidate versions.
+// It reads the lists as they are; POST /api/refresh updates them.
+func ListUpdates(c *fiber.Ctx) error {
+	distro := utils.IdentifyDistro()
+	pm, err := newPackageManager(distro)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Unsupported distribution"})
+	}
+
+	results, _ := listUpdates(pm)
+	resp := fiber.Map{"distribution": distro}
+	maps.Copy(resp, results)
+	return c.JSON(resp)
+}
+
+func listUpdates(pm pkgmgr.PackageManager) (map[string]any, error) {
+	updates, err := pm.ListUpdates()
+	if err != nil {
+		log.Println("Failed to list updates:", err)
+		return fiber.Map{"success": false, "message": err.Error()}, nil
+	}
+
+	return fiber.Map{"success": true, "count": len(updates), "updates": updates}, nil
+}
+
+// UpgradePackages upgrades the listed packages, or the whole system if none are given
+func UpgradePackages(c *fiber.Ctx) error {
+	distro := utils.IdentifyDistro()
+	pm, err := newPackageManager(distro)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Unsupported distribution"})
+	}
+
+	var body struct {
+		Packages []string `json:"packages"`
+		Async    bool     `json:"async"`
+	}
+	// An empty body means a full, synchronous upgrade
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&body); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Request must be JSON"})
+		}
+	}
+	if message := checkPackageNames(body.Packages); message != "" {
+		return c.Status(400).JSON(fiber.Map{"error": message})
+	}
+
+	if body.Async {
+		job := jobManager.Submit("upgrade", packagesResource, func(j *jobs.Job) (any, error) {
+			pm, _ := pkgmgr.NewWithRunner(distro, j.RunCommand)
+			results, err := upgradePackages(pm, body.Packages)
+			results["distribution"] = distro
+			return results, err
+		})
+		return jobAccepted(c, job)
+	}
+
+	defer jobManager.Lock(packagesResource)()
+	results, _ := upgradePackages(pm, body.Packages)
+	resp := fiber.Map{"distribution": distro}
+	maps.Copy(resp, results)
+	return c.JSON(resp)
+}
+
+func upgradePackages(pm pkgmgr.PackageManager, packages []string) (map[string]any, error) {
+	// Upgrades always want the latest lists, stale or not
+	if err := packageIndex.RefreshLists(pm); err != nil {
+		log.Println("Failed to update package lists:", err)
+	}
+
+	out, err := pm.Upgrade(packages...)
+	if err != nil {
+		log.Printf("Failed to upgrade %v: %v", packages, err)
+		return fiber.Map{"success": false, "packages": packages, "message": err.Error()}, err
+	}
+
+	return fiber.Map{"success": true, "packages": packages, "message": out}, nil
+}
+
 func SearchPackages(c *fiber.Ctx) error {
 
 	query := c.Query("query")
 	if query == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"success": false, "message": "No search query specified"})
 	}
+	if looksLikeOption(query) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"success": false, "message": "Search query can't start with \"-\""})
+	}
 
 	distro := utils.IdentifyDistro()
-	if distro == "unknown" {
+	pm, err := newPackageManager(distro)
+	if err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Unsupported distribution"})
 	}
 
-	results, _ := searchPackages(query, distro)
+	results, _ := searchPackages(pm, newAppSources(), query, c.QueryInt("limit"))
 	resp := fiber.Map{"distribution": distro, "query": query}
-	for k, v := range results {
-		resp[k] = v
-	}
+	maps.Copy(resp, results)
 	return c.JSON(resp)
 }
 
-func searchPackages(query string, distro string) (map[string]any, error) {
+func searchPackages(pm pkgmgr.PackageManager, sources map[string]pkgmgr.AppSource, query string, limit int) (map[string]any, error) {
 	if query == "" {
 		return fiber.Map{"success": false, "message": "No search query specified"}, nil
 	}
 
-	var cmd []string
-	switch distro {
-	case "fedora":
-		cmd = []string{"dnf", "search", query}
-	case "arch":
-		cmd = []string{"pacman", "-Ss", query}
-	case "debian":
-		// update first
-		_, _, _ = utils.RunCommand("sudo", "apt-get", "update")
-		cmd = []string{"apt-cache", "search", query}
+	// Until the first index build finishes, ask the package manager directly
+	var results []pkgmgr.SearchResult
+	if packageIndex.Ready() {
+		results = packageIndex.Search(query, limit)
+	} else {
+		var err error
+		results, err = pm.Search(query)
+		if err != nil {
+			log.Println("Failed to search packages:", err)
+			return fiber.Map{"success": false, "message": err.Error(), "index": packageIndex.Status()}, nil
+		}
+	}
+	for i := range results {
+		results[i].Source = nativeSource
 	}
 
-	out, errout, err := utils.RunCommand(cmd[0], cmd[1:]...)
-	if err != nil {
-		log.Println("Failed to search packages:", err, errout)
-		return fiber.Map{"success": false, "message": errout}, nil
-	}
-
-	results := []SearchResult{}
-
-	scanner := bufio.NewScanner(strings.NewReader(out))
-	switch distro {
-	case "debian":
-		for scanner.Scan() {
-			line := scanner.Text()
-			if line == "" {
-				continue
-			}
-			parts := strings.SplitN(line, " - ", 2)
-			name := strings.TrimSpace(parts[0])
-			desc := ""
-			if len(parts) > 1 {
-				desc = strings.TrimSpace(parts[1])
-			}
-			results = append(results, SearchResult{Name: name, Description: desc})
-		}
-	case "fedora":
-		// dnf search output lines generally like: "packageName : description"
-		for scanner.Scan() {
-			line := scanner.Text()
-			if line == "" || strings.HasPrefix(line, "Last metadata expiration check") {
-				continue
-			}
-			// split on first ':'
-			if strings.Contains(line, ":") && !strings.HasPrefix(line, " ") {
-				parts := strings.SplitN(line, ":", 2)
-				name := strings.TrimSpace(parts[0])
-				desc := strings.TrimSpace(parts[1])
-				results = append(results, SearchResult{Name: name, Description: desc})
-			}
+	// A failing app source shouldn't hide the native results
+	for _, name := range pkgmgr.SourceNames(sources) {
+		found, err := sources[name].Search(query)
+		if err != nil {
+			log.Printf("Failed to search %s: %v", name, err)
+			continue
 		}
-	case "arch":
-		// pacman -Ss output lines look like: "repo/packageName version ...", then description in same line after space
-		for scanner.Scan() {
-			line := scanner.Text()
-			if line == "" {
-				continue
-			}
-			if strings.HasPrefix(line, "core/") || strings.HasPrefix(line, "extra/") || strings.HasPrefix(line, "community/") {
-				parts := strings.SplitN(line, " ", 2)
-				if len(parts) < 2 {
-					continue
-				}
-				pkgFull := parts[0]
-				desc := parts[1]
-				// pkgFull format: repo/packageName-version
-				pkgParts := strings.Split(pkgFull, "/")
-				if len(pkgParts) == 2 {
-					pkgVerParts := strings.Split(pkgParts[1], "-")
-					pkgName := pkgVerParts[0]
-					results = append(results, SearchResult{Name: pkgName, Description: desc})
-				}
-			}
+		for i := range found {
+			found[i].Source = name
 		}
+		results = append(results, found...)
 	}
 
-	return fiber.Map{"success": true, "results": results}, nil
+	return fiber.Map{"success": true, "results": results, "index": packageIndex.Status()}, nil
+}
+
+// PackageInfo returns version, size, repository, dependencies and install
+// state of a single package
+func PackageInfo(c *fiber.Ctx) error {
+	name := c.Query("name")
+	if name == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "No package name specified"})
+	}
+	if looksLikeOption(name) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid package name: " + name})
+	}
+
+	distro := utils.IdentifyDistro()
+	pm, err := newPackageManager(distro)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Unsupported distribution"})
+	}
+
+	info, err := pm.Info(name)
+	if err != nil {
+		log.Printf("Failed to get package info for %s: %v", name, err)
+		return c.Status(404).JSON(fiber.Map{"distribution": distro, "success": false, "message": err.Error()})
+	}
+	return c.JSON(fiber.Map{"distribution": distro, "success": true, "package": info})
 }
 
 func ListInstalledPackages(c *fiber.Ctx) error {
 	distro := utils.IdentifyDistro()
-	if distro == "unknown" {
+	pm, err := newPackageManager(distro)
+	if err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Unsupported distribution"})
 	}
 
-	results, _ := listInstalledPackages(distro)
+	results, _ := listInstalledPackages(pm, newAppSources())
 	resp := fiber.Map{"distribution": distro}
 	maps.Copy(resp, results)
 	return c.JSON(resp)
 }
 
-func listInstalledPackages(distro string) (map[string]any, error) {
-	var cmd []string
-	switch distro {
-	case "fedora":
-		cmd = []string{"rpm", "-qa", "--qf", "%{NAME}\t%{VERSION}\n"}
-	case "arch":
-		cmd = []string{"pacman", "-Q"}
-	case "debian":
-		cmd = []string{"dpkg-query", "-W", "-f=${Package}\t${Version}\n"}
+func listInstalledPackages(pm pkgmgr.PackageManager, sources map[string]pkgmgr.AppSource) (map[string]any, error) {
+	packages, err := pm.ListInstalled()
+	if err != nil {
+		log.Println("Failed to list installed packages:", err)
+		return fiber.Map{"success": false, "message": err.Error()}, nil
 	}
 
-	out, errout, err := utils.RunCommand(cmd[0], cmd[1:]...)
-	if err != nil {
-		log.Println("Failed to list installed packages:", err, errout)
-		return fiber.Map{"success": false, "message": errout}, nil
-	}
-
-	packages := []map[string]string{}
-	scanner := bufio.NewScanner(strings.NewReader(out))
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, "\t")
-		if len(parts) == 2 {
-			packages = append(packages, map[string]string{"name": parts[0], "version": parts[1]})
-		} else if len(parts) == 1 {
-			packages = append(packages, map[string]string{"name": parts[0], "version": ""})
+	if holder, ok := pm.(pkgmgr.Holder); ok {
+		held, err := holder.ListHeld()
+		if err != nil && !errors.Is(err, pkgmgr.ErrHoldUnsupported) {
+			log.Println("Failed to list held packages:", err)
+		}
+		for i := range packages {
+			packages[i].Held = slices.Contains(held, packages[i].Name)
+		}
+	}
+	for i := range packages {
+		packages[i].Source = nativeSource
+	}
+
+	for _, name := range pkgmgr.SourceNames(sources) {
+		installed, err := sources[name].ListInstalled()
+		if err != nil {
+			log.Printf("Failed to list installed %s packages: %v", name, err)
+			continue
+		}
+		for i := range installed {
+			installed[i].Source = name
 		}
+		packages = append(packages, installed...)
 	}
 
 	return fiber.Map{"success": true, "packages": packages}, nil
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"piControlHelper/config"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// confirmation is an outstanding token for one dangerous action on one unit.
+type confirmation struct {
+	unit    string
+	action  string
+	expires time.Time
+}
+
+var (
+	confirmationsMu sync.Mutex
+	confirmations   = map[string]confirmation{}
+)
+
+// checkServicePolicy applies the service policy before the actions one
+// request takes on a unit. When they may not go ahead yet, it sends the
+// response itself and returns false along with the result of sending it.
+//
+// Requests with a dangerous action are answered with 428 and a confirmation
+// token the first time. Repeating the request with that token runs it.
+func checkServicePolicy(c *fiber.Ctx, unit, token string, actions ...string) (bool, error) {
+	policy, err := config.LoadPolicy()
+	if err != nil {
+		// A broken policy file must not quietly allow everything
+		log.Println(err)
+		return false, c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	action := strings.Join(actions, ",")
+	resp := fiber.Map{"success": false, "service": unit, "action": action}
+	dangerous := false
+	for _, a := range actions {
+		if message := policy.Check(unit, a); message != "" {
+			resp["message"] = message
+			return false, c.Status(403).JSON(resp)
+		}
+		dangerous = dangerous || policy.NeedsConfirmation(a)
+	}
+	if !dangerous || useConfirmation(token, unit, action) {
+		return true, nil
+	}
+
+	token, expires, err := newConfirmation(unit, action, time.Duration(policy.ConfirmationTTL))
+	if err != nil {
+		return false, c.Status(500).JSON(fiber.Map{"error": "Failed to create confirmation token"})
+	}
+	resp["confirmation_required"] = true
+	resp["confirm_token"] = token
+	resp["expires_at"] = expires.Format(time.RFC3339)
+	resp["message"] = fmt.Sprintf("Repeat the request with confirm_token to %s %s", action, unit)
+	return false, c.Status(fiber.StatusPreconditionRequired).JSON(resp)
+}
+
+func newConfirmation(unit, action string, ttl time.Duration) (string, time.Time, error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(tokenBytes)
+	expires := time.Now().Add(ttl)
+
+	confirmationsMu.Lock()
+	defer confirmationsMu.Unlock()
+	now := time.Now()
+	for t, pending := range confirmations {
+		if now.After(pending.expires) {
+			delete(confirmations, t)
+		}
+	}
+	confirmations[token] = confirmation{unit: unit, action: action, expires: expires}
+	return token, expires, nil
+}
+
+// useConfirmation consumes token if it confirms action on unit. Tokens are
+// single use.
+func useConfirmation(token, unit, action string) bool {
+	if token == "" {
+		return false
+	}
+	confirmationsMu.Lock()
+	defer confirmationsMu.Unlock()
+	pending, ok := confirmations[token]
+	if !ok || pending.unit != unit || pending.action != action {
+		return false
+	}
+	delete(confirmations, token)
+	return time.Now().Before(pending.expires)
+}
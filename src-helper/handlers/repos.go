@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"maps"
+	"piControlHelper/pkgmgr"
+	"piControlHelper/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// repositoryManager returns the distro's backend if it can manage package
+// sources. Only apt, dnf and pacman can.
+func repositoryManager(distro string) (pkgmgr.RepositoryManager, bool) {
+	pm, err := newPackageManager(distro)
+	if err != nil {
+		return nil, false
+	}
+	repos, ok := pm.(pkgmgr.RepositoryManager)
+	return repos, ok
+}
+
+// ListRepositories lists the configured package repositories
+func ListRepositories(c *fiber.Ctx) error {
+	distro := utils.IdentifyDistro()
+	repos, ok := repositoryManager(distro)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "Repository management is not supported on this distribution"})
+	}
+
+	results, _ := listRepositories(repos)
+	resp := fiber.Map{"distribution": distro}
+	maps.Copy(resp, results)
+	return c.JSON(resp)
+}
+
+func listRepositories(repos pkgmgr.RepositoryManager) (map[string]any, error) {
+	list, err := repos.ListRepositories()
+	if err != nil {
+		log.Println("Failed to list repositories:", err)
+		return fiber.Map{"success": false, "message": err.Error()}, nil
+	}
+
+	return fiber.Map{"success": true, "repositories": list}, nil
+}
+
+// AddRepository adds a package repository and its signing key
+func AddRepository(c *fiber.Ctx) error {
+	distro := utils.IdentifyDistro()
+	repos, ok := repositoryManager(distro)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "Repository management is not supported on this distribution"})
+	}
+
+	var spec pkgmgr.RepositorySpec
+	if err := c.BodyParser(&spec); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Request must be JSON"})
+	}
+	if spec.URL == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "No repository URL specified"})
+	}
+
+	defer jobManager.Lock(packagesResource)()
+	repo, err := repos.AddRepository(spec)
+	if err != nil {
+		log.Printf("Failed to add repository %s: %v", spec.URL, err)
+		return c.JSON(fiber.Map{"distribution": distro, "success": false, "message": err.Error()})
+	}
+	return c.JSON(fiber.Map{"distribution": distro, "success": true, "repository": repo})
+}
+
+// ControlRepository enables, disables or removes a package repository
+func ControlRepository(c *fiber.Ctx) error {
+	distro := utils.IdentifyDistro()
+	repos, ok := repositoryManager(distro)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "Repository management is not supported on this distribution"})
+	}
+
+	var body struct {
+		ID     string `json:"id"`
+		Action string `json:"action"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Request must be JSON"})
+	}
+	if body.ID == "" || body.Action == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Repository id and action required"})
+	}
+
+	defer jobManager.Lock(packagesResource)()
+	var err error
+	switch body.Action {
+	case "enable":
+		err = repos.SetRepositoryEnabled(body.ID, true)
+	case "disable":
+		err = repos.SetRepositoryEnabled(body.ID, false)
+	case "remove":
+		err = repos.RemoveRepository(body.ID)
+	default:
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid action. Valid actions are: enable, disable, remove"})
+	}
+
+	resp := fiber.Map{"distribution": distro, "id": body.ID, "action": body.Action}
+	if err != nil {
+		log.Printf("Failed to %s repository %s: %v", body.Action, body.ID, err)
+		resp["success"] = false
+		resp["message"] = err.Error()
+		if errors.Is(err, pkgmgr.ErrRepositoryNotFound) {
+			return c.Status(404).JSON(resp)
+		}
+		if errors.Is(err, pkgmgr.ErrRepositoryRequired) {
+			return c.Status(409).JSON(resp)
+		}
+		return c.JSON(resp)
+	}
+	resp["success"] = true
+	return c.JSON(resp)
+}
@@ -1,63 +1,118 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"os/exec"
+	"piControlHelper/jobs"
+	"piControlHelper/pkgmgr"
+	"piControlHelper/systemd"
 	"piControlHelper/utils"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
 )
 
-type ServiceInfo struct {
-	Name        string `json:"name"`
-	LoadState   string `json:"load_state"`
-	ActiveState string `json:"active_state"`
-	SubState    string `json:"sub_state"`
-	Description string `json:"description"`
+// unitTypes are the systemd unit types the helper manages.
+var unitTypes = []string{"service", "timer", "socket", "mount", "path", "target"}
+
+// normalizeUnit adds ".service" to bare names, so "nginx" keeps working,
+// and leaves names with a unit type suffix alone.
+func normalizeUnit(name string) string {
+	if slices.Contains(unitTypes, systemd.UnitType(name)) {
+		return name
+	}
+	return name + ".service"
 }
 
+// unitTypeFilter reads the "type" query parameter. No type means services,
+// as before; "all" means every managed type.
+func unitTypeFilter(c *fiber.Ctx) ([]string, bool) {
+	switch t := c.Query("type", "service"); {
+	case t == "all":
+		return unitTypes, true
+	case slices.Contains(unitTypes, t):
+		return []string{t}, true
+	default:
+		return nil, false
+	}
+}
+
+const invalidUnitType = "Invalid unit type. Valid types are: service, timer, socket, mount, path, target, all"
+
+// UnitFileInfo is an installed unit file, whether or not the unit is loaded.
+type UnitFileInfo struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	State  string `json:"state"`
+	Preset string `json:"preset,omitempty"`
+}
+
+// ListServices lists loaded units of the requested type (services by default)
 func ListServices(c *fiber.Ctx) error {
-	results, _ := listSystemdServices()
+	types, ok := unitTypeFilter(c)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": invalidUnitType})
+	}
+	results, _ := listSystemdServices(types)
 	return c.JSON(results)
 }
 
-func listSystemdServices() (map[string]any, error) {
-	cmd := []string{"systemctl", "list-units", "--type=service", "--all", "--no-pager", "--plain"}
-	out, errout, err := utils.RunCommand(cmd[0], cmd[1:]...)
+func listSystemdServices(types []string) (map[string]any, error) {
+	units, err := systemd.ListUnits(types...)
 	if err != nil {
-		log.Println("Failed to list systemd services:", err, errout)
+		log.Println("Failed to list systemd units:", err)
+		return fiber.Map{"success": false, "message": err.Error()}, nil
+	}
+
+	return fiber.Map{"success": true, "services": units}, nil
+}
+
+// ListUnitFiles lists installed unit files, including units that are not
+// loaded because they are disabled or have never run
+func ListUnitFiles(c *fiber.Ctx) error {
+	types, ok := unitTypeFilter(c)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": invalidUnitType})
+	}
+	results, _ := listUnitFiles(types)
+	return c.JSON(results)
+}
+
+func listUnitFiles(types []string) (map[string]any, error) {
+	typeFilter := "--type=" + strings.Join(types, ",")
+	out, errout, err := utils.RunCommand("systemctl", "list-unit-files", typeFilter, "--no-pager", "--no-legend", "--plain")
+	if err != nil {
+		log.Println("Failed to list unit files:", err, errout)
 		return fiber.Map{"success": false, "message": errout}, nil
 	}
 
-	lines := strings.Split(out, "\n")
-	services := []ServiceInfo{}
-	if len(lines) > 1 {
-		for _, line := range lines[1:] { // skip header
-			line = strings.TrimSpace(line)
-			if line == "" || !strings.Contains(line, ".service") {
-				continue
-			}
-			parts := regexp.MustCompile(`\s+`).Split(line, 5)
-			if len(parts) < 4 {
-				continue
-			}
-			desc := ""
-			if len(parts) == 5 {
-				desc = parts[4]
-			}
-			service := ServiceInfo{
-				Name:        parts[0],
-				LoadState:   parts[1],
-				ActiveState: parts[2],
-				SubState:    parts[3],
-				Description: desc,
-			}
-			services = append(services, service)
+	// Lines look like "backup.timer  enabled  enabled"; older systemd has
+	// no preset column
+	units := []UnitFileInfo{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !slices.Contains(types, systemd.UnitType(fields[0])) {
+			continue
 		}
+		unit := UnitFileInfo{Name: fields[0], Type: systemd.UnitType(fields[0]), State: fields[1]}
+		if len(fields) > 2 {
+			unit.Preset = fields[2]
+		}
+		units = append(units, unit)
 	}
 
-	return fiber.Map{"success": true, "services": services}, nil
+	return fiber.Map{"success": true, "units": units}, nil
 }
 
 func ServiceStatus(c *fiber.Ctx) error {
@@ -66,43 +121,249 @@ func ServiceStatus(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "No service name specified"})
 	}
 
-	results, _ := getServiceStatus(serviceName)
+	results, err := getServiceStatus(serviceName)
+	if errors.Is(err, systemd.ErrUnitNotFound) {
+		return c.Status(404).JSON(results)
+	}
 	return c.JSON(results)
 }
 
 func getServiceStatus(serviceName string) (map[string]any, error) {
-	if !strings.HasSuffix(serviceName, ".service") {
-		serviceName += ".service"
-	}
+	serviceName = normalizeUnit(serviceName)
 
-	out, _, err := utils.RunCommand("systemctl", "status", serviceName, "--no-pager")
+	status, err := systemd.GetUnitStatus(serviceName)
+	if errors.Is(err, systemd.ErrUnitNotFound) {
+		return fiber.Map{"success": false, "service": serviceName, "message": "Unit " + serviceName + " not found"}, err
+	}
 	if err != nil {
 		log.Println("Failed to get service status:", err)
+		return fiber.Map{"success": false, "service": serviceName, "message": err.Error()}, err
 	}
 
-	activeStatus := "Unknown"
-	re := regexp.MustCompile(`Active:\s*(.*)`)
-	matches := re.FindStringSubmatch(out)
-	if len(matches) > 1 {
-		activeStatus = matches[1]
-	}
-
-	enabledOut, _, _ := utils.RunCommand("systemctl", "is-enabled", serviceName)
-	enabledStatus := strings.TrimSpace(enabledOut)
+	// full_status is only meant for display; nothing is parsed out of it
+	out, _, _ := utils.RunCommand("systemctl", "status", serviceName, "--no-pager")
 
 	return fiber.Map{
 		"success":        true,
-		"service":        serviceName,
-		"active_status":  activeStatus,
-		"enabled_status": enabledStatus,
+		"service":        status.Name,
+		"active_status":  fmt.Sprintf("%s (%s)", status.ActiveState, status.SubState),
+		"enabled_status": status.UnitFileState,
 		"full_status":    out,
+		"status":         status,
 	}, nil
 }
 
+// LogEntry is one journal record of a unit.
+type LogEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Priority is the syslog level, from 0 (emerg) to 7 (debug)
+	Priority   int    `json:"priority"`
+	Identifier string `json:"identifier,omitempty"`
+	PID        int    `json:"pid,omitempty"`
+	Message    string `json:"message"`
+	Cursor     string `json:"cursor"`
+}
+
+// LogEvent is sent for every new entry on /api/service/logs/stream.
+// Type is one of: entry, error.
+type LogEvent struct {
+	Type    string    `json:"type"`
+	Entry   *LogEntry `json:"entry,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+const maxLogLines = 10000
+
+// journalPriority matches a level or a "from..to" range of levels, by name
+// or number, as journalctl --priority accepts them.
+var journalPriority = regexp.MustCompile(`^(emerg|alert|crit|err|warning|notice|info|debug|[0-7])(\.\.(emerg|alert|crit|err|warning|notice|info|debug|[0-7]))?$`)
+
+// logQuery holds the parameters shared by ServiceLogs and StreamServiceLogs.
+type logQuery struct {
+	Unit     string
+	Lines    int
+	Since    string
+	Priority string
+}
+
+// newLogQuery reads the log parameters through query, which is the Query
+// method of either a fiber.Ctx or a websocket.Conn. It returns a message
+// when they are invalid.
+func newLogQuery(query func(key string, defaultValue ...string) string) (logQuery, string) {
+	q := logQuery{
+		Unit:     query("name"),
+		Since:    query("since"),
+		Priority: query("priority"),
+	}
+	if q.Unit == "" {
+		return q, "No service name specified"
+	}
+	if strings.HasPrefix(q.Unit, "-") {
+		return q, "Invalid unit name"
+	}
+	q.Unit = normalizeUnit(q.Unit)
+
+	lines, err := strconv.Atoi(query("lines", "100"))
+	if err != nil || lines < 1 {
+		return q, "lines must be a positive number"
+	}
+	q.Lines = min(lines, maxLogLines)
+
+	if q.Priority != "" && !journalPriority.MatchString(q.Priority) {
+		return q, "Invalid priority. Use a level from 0 to 7, a name such as err or warning, or a range such as err..warning"
+	}
+	return q, ""
+}
+
+// args builds the journalctl arguments. Values are attached with "=" so
+// they can't be mistaken for options.
+func (q logQuery) args(follow bool) []string {
+	args := []string{"--unit=" + q.Unit, "--output=json", "--no-pager", "--lines=" + strconv.Itoa(q.Lines)}
+	if q.Since != "" {
+		args = append(args, "--since="+q.Since)
+	}
+	if q.Priority != "" {
+		args = append(args, "--priority="+q.Priority)
+	}
+	if follow {
+		args = append(args, "--follow")
+	}
+	return args
+}
+
+// ServiceLogs returns the most recent journal entries of a unit
+func ServiceLogs(c *fiber.Ctx) error {
+	q, message := newLogQuery(c.Query)
+	if message != "" {
+		return c.Status(400).JSON(fiber.Map{"error": message})
+	}
+
+	results, _ := getServiceLogs(q)
+	return c.JSON(results)
+}
+
+func getServiceLogs(q logQuery) (map[string]any, error) {
+	out, errout, err := utils.RunCommand("journalctl", q.args(false)...)
+	if err != nil {
+		log.Println("Failed to read service logs:", err, errout)
+		return fiber.Map{"success": false, "service": q.Unit, "message": errout}, nil
+	}
+
+	entries := []LogEntry{}
+	for _, line := range strings.Split(out, "\n") {
+		if entry, ok := parseJournalEntry(line); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return fiber.Map{"success": true, "service": q.Unit, "entries": entries}, nil
+}
+
+// StreamServiceLogs sends the recent journal entries of a unit over a
+// WebSocket, then keeps sending new ones until the client disconnects.
+func StreamServiceLogs(conn *websocket.Conn) {
+	defer conn.Close()
+
+	q, message := newLogQuery(conn.Query)
+	if message != "" {
+		conn.WriteJSON(LogEvent{Type: "error", Message: message})
+		return
+	}
+
+	// The client doesn't send anything; reading only notices when it goes
+	// away, so journalctl can be stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	cmd := exec.CommandContext(ctx, "journalctl", q.args(true)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		conn.WriteJSON(LogEvent{Type: "error", Message: err.Error()})
+		return
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		entry, ok := parseJournalEntry(scanner.Text())
+		if !ok {
+			continue
+		}
+		if err := conn.WriteJSON(LogEvent{Type: "entry", Entry: &entry}); err != nil {
+			break
+		}
+	}
+
+	disconnected := ctx.Err() != nil
+	cancel()
+	if err := cmd.Wait(); err != nil && !disconnected {
+		log.Println("Failed to follow service logs:", err, stderr.String())
+		conn.WriteJSON(LogEvent{Type: "error", Message: strings.TrimSpace(stderr.String())})
+	}
+}
+
+// parseJournalEntry decodes one line of journalctl --output=json. All
+// journal fields are strings, except that MESSAGE is an array of bytes when
+// it isn't valid UTF-8.
+func parseJournalEntry(line string) (LogEntry, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return LogEntry{}, false
+	}
+
+	entry := LogEntry{
+		Identifier: journalField(fields["SYSLOG_IDENTIFIER"]),
+		Message:    journalField(fields["MESSAGE"]),
+		Cursor:     journalField(fields["__CURSOR"]),
+		Priority:   6, // journald's default for entries without one
+	}
+	if usec, err := strconv.ParseInt(journalField(fields["__REALTIME_TIMESTAMP"]), 10, 64); err == nil {
+		entry.Timestamp = time.UnixMicro(usec)
+	}
+	if priority, err := strconv.Atoi(journalField(fields["PRIORITY"])); err == nil {
+		entry.Priority = priority
+	}
+	if pid, err := strconv.Atoi(journalField(fields["_PID"])); err == nil {
+		entry.PID = pid
+	}
+	return entry, true
+}
+
+func journalField(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	var values []int
+	if err := json.Unmarshal(raw, &values); err == nil {
+		data := make([]byte, len(values))
+		for i, b := range values {
+			data[i] = byte(b)
+		}
+		return strings.ToValidUTF8(string(data), "\uFFFD")
+	}
+	return ""
+}
+
 func ControlService(c *fiber.Ctx) error {
 	var body struct {
 		Service string `json:"service"`
 		Action  string `json:"action"`
+		Async   bool   `json:"async"`
+		// ConfirmToken confirms a dangerous action, see checkServicePolicy
+		ConfirmToken string `json:"confirm_token"`
 	}
 	if err := c.BodyParser(&body); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Request must be JSON"})
@@ -111,22 +372,44 @@ func ControlService(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Service and action required"})
 	}
 
-	results, _ := controlService(body.Service, body.Action)
+	if strings.HasPrefix(body.Service, "-") {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid unit name"})
+	}
+
+	if ok, err := checkServicePolicy(c, normalizeUnit(body.Service), body.ConfirmToken, body.Action); !ok {
+		return err
+	}
+
+	resource := serviceResource(normalizeUnit(body.Service))
+	if body.Async {
+		job := jobManager.Submit("service_"+body.Action, resource, func(j *jobs.Job) (any, error) {
+			return controlService(j.RunCommand, body.Service, body.Action)
+		})
+		return jobAccepted(c, job)
+	}
+
+	defer jobManager.Lock(resource)()
+	results, _ := controlService(utils.RunCommand, body.Service, body.Action)
 	return c.JSON(results)
 }
 
-func controlService(serviceName, action string) (map[string]any, error) {
-	if !strings.HasSuffix(serviceName, ".service") {
-		serviceName += ".service"
-	}
+// controlService runs a systemctl action through run, so a job records the
+// command's output and exit status. The error is only set for jobs; the
+// results map reports failures to synchronous callers.
+func controlService(run pkgmgr.Runner, serviceName, action string) (map[string]any, error) {
+	serviceName = normalizeUnit(serviceName)
 
-	validActions := map[string]bool{"start": true, "stop": true, "enable": true, "disable": true, "restart": true}
+	validActions := map[string]bool{
+		"start": true, "stop": true, "enable": true, "disable": true, "restart": true,
+		"reload": true, "mask": true, "unmask": true, "reset-failed": true,
+	}
 	if !validActions[action] {
-		return fiber.Map{"success": false, "message": "Invalid action. Valid actions are: start, stop, enable, disable, restart"}, nil
+		message := "Invalid action. Valid actions are: start, stop, enable, disable, restart, reload, mask, unmask, reset-failed"
+		return fiber.Map{"success": false, "message": message}, errors.New(message)
 	}
 
 	cmd := []string{"sudo", "systemctl", action, serviceName}
-	out, errout, err := utils.RunCommand(cmd[0], cmd[1:]...)
+	out, errout, err := run(cmd[0], cmd[1:]...)
 	if err != nil {
 		log.Printf("Failed to %s service %s: %v\n%s", action, serviceName, err, errout)
 		return fiber.Map{
@@ -134,7 +417,7 @@ func controlService(serviceName, action string) (map[string]any, error) {
 			"service": serviceName,
 			"action":  action,
 			"message": errout,
-		}, nil
+		}, fmt.Errorf("failed to %s %s: %w", action, serviceName, err)
 	}
 
 	return fiber.Map{
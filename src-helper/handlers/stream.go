@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"log"
+	"piControlHelper/audit"
+	"piControlHelper/pkgmgr"
+	"piControlHelper/utils"
+	"sync"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// StreamRequest is the first message a client sends on /api/packages/stream.
+type StreamRequest struct {
+	Action string `json:"action"`
+	// Packages may pin versions or pick an app source, like /api/install
+	Packages []PackageRequest `json:"packages"`
+}
+
+// StreamEvent is sent to the client for every step of a streamed operation.
+// Type is one of: start, output, finish, done, error.
+type StreamEvent struct {
+	Type         string          `json:"type"`
+	Package      string          `json:"package,omitempty"`
+	Stream       string          `json:"stream,omitempty"`
+	Data         string          `json:"data,omitempty"`
+	Success      *bool           `json:"success,omitempty"`
+	Message      string          `json:"message,omitempty"`
+	Distribution string          `json:"distribution,omitempty"`
+	Results      []PackageResult `json:"results,omitempty"`
+}
+
+// StreamPackages installs or uninstalls packages over a WebSocket, sending
+// the package manager's output line by line as it runs.
+func StreamPackages(conn *websocket.Conn) {
+	defer conn.Close()
+
+	var writeMu sync.Mutex
+	send := func(event StreamEvent) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if err := conn.WriteJSON(event); err != nil {
+			log.Println("Failed to write stream event:", err)
+		}
+	}
+
+	// Logged once the connection is done, like the REST endpoints
+	entry := audit.Entry{Time: time.Now(), Action: "package.stream", Method: "GET", Path: "/api/packages/stream", Result: audit.ResultFailure}
+	auditIdentity(&entry, conn.Locals)
+	defer func() {
+		entry.DurationMS = time.Since(entry.Time).Milliseconds()
+		writeAudit(entry)
+	}()
+	fail := func(message string) {
+		entry.Message = message
+		send(StreamEvent{Type: "error", Message: message})
+	}
+
+	var req StreamRequest
+	if err := conn.ReadJSON(&req); err != nil {
+		fail("Request must be JSON")
+		return
+	}
+	entry.Params = map[string]any{"action": req.Action, "packages": req.Packages}
+	if req.Action != "install" && req.Action != "uninstall" {
+		fail("Invalid action. Valid actions are: install, uninstall")
+		return
+	}
+	entry.Action = "package." + req.Action
+	if len(req.Packages) == 0 {
+		fail("No packages specified")
+		return
+	}
+
+	var current string
+	onLine := func(stream, line string) {
+		send(StreamEvent{Type: "output", Package: current, Stream: stream, Data: line})
+	}
+	distro := utils.IdentifyDistro()
+	run := func(name string, args ...string) (string, string, error) {
+		return utils.StreamCommand(onLine, name, args...)
+	}
+	pm, err := pkgmgr.NewWithRunner(distro, run)
+	if err != nil {
+		fail("Unsupported distribution")
+		return
+	}
+	sources := pkgmgr.SourcesWithRunner(run)
+	if message := checkPackageRequests(req.Packages, sources); message != "" {
+		fail(message)
+		return
+	}
+
+	defer jobManager.Lock(packagesResource)()
+
+	if req.Action == "install" {
+		if err := packageIndex.RefreshListsIfStale(pm); err != nil {
+			log.Println("Failed to update package lists:", err)
+		}
+	}
+
+	var results []PackageResult
+	for _, pkg := range req.Packages {
+		current = pkg.Name
+		send(StreamEvent{Type: "start", Package: pkg.Name})
+
+		var out string
+		if req.Action == "install" {
+			out, err = installPackage(pm, sources, pkg)
+		} else {
+			out, err = removePackage(pm, sources, pkg)
+		}
+
+		result := pkg.result()
+		result.Success, result.Message = err == nil, out
+		if err != nil {
+			result.Message = err.Error()
+			log.Printf("Failed to %s %s: %v", req.Action, pkg.Name, err)
+		}
+		results = append(results, result)
+		send(StreamEvent{Type: "finish", Package: pkg.Name, Success: &result.Success, Message: result.Message})
+	}
+
+	entry.Result = audit.ResultSuccess
+	if err := failedPackages(results); err != nil {
+		entry.Result, entry.Message = audit.ResultFailure, err.Error()
+	}
+	send(StreamEvent{Type: "done", Distribution: distro, Results: results})
+}
@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"piControlHelper/systemd"
+	"piControlHelper/utils"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// unitDir is where administrator unit files and drop-ins live. Units
+// installed by packages elsewhere can only be changed through drop-ins.
+var unitDir = "/etc/systemd/system"
+
+// vendorUnitDirs hold unit files installed by packages.
+var vendorUnitDirs = []string{"/usr/lib/systemd/system", "/lib/systemd/system"}
+
+var (
+	unitNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9:_.@-]*\.(service|timer|socket|mount|path|target)$`)
+	dropInPattern   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*\.conf$`)
+)
+
+// unitFilePath returns the path of a unit file under unitDir, or of one of
+// its drop-ins when dropin is set. Drop-in names get a ".conf" suffix if
+// they lack one. It returns a message when a name is invalid.
+func unitFilePath(name, dropin string) (string, string, string) {
+	name = normalizeUnit(name)
+	if !unitNamePattern.MatchString(name) {
+		return "", "", "Invalid unit name"
+	}
+	if dropin == "" {
+		return name, filepath.Join(unitDir, name), ""
+	}
+	if !strings.HasSuffix(dropin, ".conf") {
+		dropin += ".conf"
+	}
+	if !dropInPattern.MatchString(dropin) {
+		return "", "", "Invalid drop-in name"
+	}
+	return name, filepath.Join(unitDir, name+".d", dropin), ""
+}
+
+// ReadUnitFile returns a unit file or drop-in under /etc/systemd/system
+func ReadUnitFile(c *fiber.Ctx) error {
+	name, path, message := unitFilePath(c.Query("name"), c.Query("dropin"))
+	if message != "" {
+		return c.Status(400).JSON(fiber.Map{"error": message})
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c.Status(404).JSON(fiber.Map{"success": false, "unit": name, "message": path + " does not exist"})
+	}
+	if err != nil {
+		return c.JSON(fiber.Map{"success": false, "unit": name, "message": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"unit":     name,
+		"path":     path,
+		"content":  string(data),
+		"drop_ins": listDropIns(name),
+	})
+}
+
+// listDropIns returns the file names of the drop-ins of a unit in unitDir.
+func listDropIns(name string) []string {
+	dropins := []string{}
+	entries, _ := os.ReadDir(filepath.Join(unitDir, name+".d"))
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".conf") {
+			dropins = append(dropins, entry.Name())
+		}
+	}
+	return dropins
+}
+
+// WriteUnitFile creates or replaces a unit file or drop-in, verifies it and
+// reloads systemd. The unit can be enabled and (re)started in the same call.
+func WriteUnitFile(c *fiber.Ctx) error {
+	var body struct {
+		Name    string `json:"name"`
+		DropIn  string `json:"dropin"`
+		Content string `json:"content"`
+		Enable  bool   `json:"enable"`
+		Start   bool   `json:"start"`
+		// ConfirmToken confirms a dangerous action, see checkServicePolicy
+		ConfirmToken string `json:"confirm_token"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Request must be JSON"})
+	}
+	if body.Name == "" || body.Content == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Unit name and content required"})
+	}
+	name, path, message := unitFilePath(body.Name, body.DropIn)
+	if message != "" {
+		return c.Status(400).JSON(fiber.Map{"error": message})
+	}
+
+	actions := []string{"edit"}
+	if body.Enable {
+		actions = append(actions, "enable")
+	}
+	if body.Start {
+		actions = append(actions, "restart")
+	}
+	if ok, err := checkServicePolicy(c, name, body.ConfirmToken, actions...); !ok {
+		return err
+	}
+
+	// A drop-in is verified together with the unit it extends
+	unitFile := ""
+	if body.DropIn != "" {
+		status, err := systemd.GetUnitStatus(name)
+		if errors.Is(err, systemd.ErrUnitNotFound) {
+			return c.Status(404).JSON(fiber.Map{"success": false, "unit": name, "message": "Unit " + name + " not found"})
+		}
+		if err != nil {
+			return c.JSON(fiber.Map{"success": false, "unit": name, "message": err.Error()})
+		}
+		if status.UnitFile == "" {
+			return c.Status(400).JSON(fiber.Map{"success": false, "unit": name, "message": "Unit " + name + " has no unit file to extend"})
+		}
+		unitFile = status.UnitFile
+	}
+
+	defer jobManager.Lock(serviceResource(name))()
+	results, _ := writeUnitFile(name, path, unitFile, body.Content, body.Enable, body.Start)
+	return c.JSON(results)
+}
+
+// writeUnitFile verifies content and only then installs it at path. For a
+// drop-in, unitFile is the unit it extends.
+func writeUnitFile(name, path, unitFile, content string, enable, start bool) (map[string]any, error) {
+	resp := fiber.Map{"unit": name, "path": path}
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	_, err := os.Stat(path)
+	resp["created"] = errors.Is(err, fs.ErrNotExist)
+
+	verifyOut, verified, err := verifyUnitFile(path, unitFile, content)
+	resp["verify"] = strings.TrimSpace(verifyOut)
+	if err != nil {
+		resp["success"] = false
+		resp["message"] = err.Error()
+		return resp, nil
+	}
+	if !verified {
+		resp["success"] = false
+		resp["message"] = "Unit verification failed"
+		return resp, nil
+	}
+
+	if err := utils.InstallFile(utils.RunCommand, path, []byte(content)); err != nil {
+		log.Printf("Failed to write %s: %v", path, err)
+		resp["success"] = false
+		resp["message"] = err.Error()
+		return resp, nil
+	}
+
+	if err := daemonReload(); err != nil {
+		resp["success"] = false
+		resp["message"] = err.Error()
+		return resp, nil
+	}
+
+	// restart starts a stopped unit too, and makes a running one pick up
+	// the new configuration
+	var actions []string
+	if enable {
+		actions = append(actions, "enable")
+	}
+	if start {
+		actions = append(actions, "restart")
+	}
+	results := runUnitActions(name, actions...)
+	resp["actions"] = results
+	resp["success"] = true
+	if len(results) > 0 {
+		if last := results[len(results)-1]; last["success"] != true {
+			resp["success"] = false
+			resp["message"] = last["message"]
+		}
+	}
+	return resp, nil
+}
+
+// DeleteUnitFile removes a unit file or drop-in and reloads systemd. Units
+// with no packaged copy to fall back to are stopped and disabled first.
+func DeleteUnitFile(c *fiber.Ctx) error {
+	dropin := c.Query("dropin")
+	name, path, message := unitFilePath(c.Query("name"), dropin)
+	if message != "" {
+		return c.Status(400).JSON(fiber.Map{"error": message})
+	}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return c.Status(404).JSON(fiber.Map{"success": false, "unit": name, "message": path + " does not exist"})
+	}
+
+	// Removing a drop-in only changes the unit's configuration
+	action := "delete"
+	if dropin != "" {
+		action = "edit"
+	}
+	if ok, err := checkServicePolicy(c, name, c.Query("confirm_token"), action); !ok {
+		return err
+	}
+
+	defer jobManager.Lock(serviceResource(name))()
+	results, _ := deleteUnitFile(name, path, dropin == "")
+	return c.JSON(results)
+}
+
+func deleteUnitFile(name, path string, unitFile bool) (map[string]any, error) {
+	resp := fiber.Map{"unit": name, "path": path}
+	// Both are attempted: a unit that isn't running may still be enabled
+	if unitFile && !hasVendorUnit(name) {
+		actions := []map[string]any{}
+		for _, action := range []string{"stop", "disable"} {
+			result, _ := controlService(utils.RunCommand, name, action)
+			actions = append(actions, result)
+		}
+		resp["actions"] = actions
+	}
+
+	if err := removeUnitFile(path); err != nil {
+		log.Printf("Failed to remove %s: %v", path, err)
+		resp["success"] = false
+		resp["message"] = err.Error()
+		return resp, nil
+	}
+	if err := daemonReload(); err != nil {
+		resp["success"] = false
+		resp["message"] = err.Error()
+		return resp, nil
+	}
+
+	resp["success"] = true
+	return resp, nil
+}
+
+// runUnitActions runs controlService actions in order, stopping at the
+// first failure.
+func runUnitActions(name string, actions ...string) []map[string]any {
+	results := []map[string]any{}
+	for _, action := range actions {
+		result, _ := controlService(utils.RunCommand, name, action)
+		results = append(results, result)
+		if success, _ := result["success"].(bool); !success {
+			break
+		}
+	}
+	return results
+}
+
+func hasVendorUnit(name string) bool {
+	for _, dir := range vendorUnitDirs {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyUnitFile runs systemd-analyze verify on content before it is
+// installed at path, since systemd loads units that aren't loaded yet on
+// demand and could pick up a broken file. The content is staged in a
+// temporary directory under the same name. A drop-in is staged in a ".d"
+// directory next to a copy of unitFile, the unit it extends, which
+// systemd-analyze then reads along with it. It reports whether the unit
+// verified, with the tool's output.
+func verifyUnitFile(path, unitFile, content string) (string, bool, error) {
+	dir, err := os.MkdirTemp("", "picontrol-unit-*")
+	if err != nil {
+		return "", false, err
+	}
+	defer os.RemoveAll(dir)
+
+	staged := filepath.Join(dir, filepath.Base(path))
+	verifyPath := staged
+	if unitFile != "" {
+		unit, err := os.ReadFile(unitFile)
+		if err != nil {
+			return "", false, err
+		}
+		verifyPath = filepath.Join(dir, filepath.Base(unitFile))
+		if err := os.WriteFile(verifyPath, unit, 0644); err != nil {
+			return "", false, err
+		}
+		staged = filepath.Join(dir, filepath.Base(filepath.Dir(path)), filepath.Base(path))
+		if err := os.Mkdir(filepath.Dir(staged), 0755); err != nil {
+			return "", false, err
+		}
+	}
+	if err := os.WriteFile(staged, []byte(content), 0644); err != nil {
+		return "", false, err
+	}
+
+	_, verifyOut, err := utils.RunCommand("systemd-analyze", "verify", verifyPath)
+	// Messages name the files where they will be installed
+	verifyOut = strings.ReplaceAll(verifyOut, staged, path)
+	if unitFile != "" {
+		verifyOut = strings.ReplaceAll(verifyOut, verifyPath, unitFile)
+	}
+	return verifyOut, err == nil, nil
+}
+
+func removeUnitFile(path string) error {
+	return sudo("rm", "-f", path)
+}
+
+func daemonReload() error {
+	return sudo("systemctl", "daemon-reload")
+}
+
+// sudo runs a privileged command and turns its stderr into the error.
+func sudo(args ...string) error {
+	_, errout, err := utils.RunCommand("sudo", args...)
+	if err != nil && strings.TrimSpace(errout) != "" {
+		return errors.New(strings.TrimSpace(errout))
+	}
+	return err
+}
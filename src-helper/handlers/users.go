@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"piControlHelper/users"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// usersMu serializes changes to accounts, so two requests can't remove the
+// last two admins at once.
+var usersMu sync.Mutex
+
+// UserInfo is a user as listed by the API, without the TOTP secret.
+type UserInfo struct {
+	Name        string     `json:"name"`
+	Role        users.Role `json:"role"`
+	AccountName string     `json:"account_name"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// ListUsers returns every user account
+func ListUsers(c *fiber.Ctx) error {
+	list := []UserInfo{}
+	for _, u := range userStore.List() {
+		list = append(list, UserInfo{Name: u.Name, Role: u.Role, AccountName: u.AccountName, CreatedAt: u.CreatedAt})
+	}
+	return c.JSON(fiber.Map{"success": true, "users": list})
+}
+
+// CreateUser adds a user and returns the QR code to enroll their TOTP secret
+func CreateUser(c *fiber.Ctx) error {
+	var body struct {
+		Username string     `json:"username"`
+		Role     users.Role `json:"role"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Request must be JSON"})
+	}
+	if !users.ValidName(body.Username) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid username"})
+	}
+	if !body.Role.Valid() {
+		return c.Status(400).JSON(fiber.Map{"error": "Role must be viewer, operator or admin"})
+	}
+
+	user, key, err := newTOTPUser(body.Username, body.Role)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"success": false, "message": err.Error()})
+	}
+	usersMu.Lock()
+	err = userStore.Add(user)
+	usersMu.Unlock()
+	if errors.Is(err, users.ErrExists) {
+		return c.Status(409).JSON(fiber.Map{"success": false, "message": "User " + body.Username + " already exists"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"success": false, "message": err.Error()})
+	}
+
+	results, err := enrollment(user, key.URL())
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"success": false, "message": err.Error()})
+	}
+	log.Printf("👤 User %s (%s) created by %s", user.Name, user.Role, currentUser(c))
+	results["success"] = true
+	results["message"] = "User created. Scan the QR code with the user's authenticator app."
+	return c.Status(201).JSON(results)
+}
+
+// UpdateUser changes the role of a user
+func UpdateUser(c *fiber.Ctx) error {
+	name := c.Params("name")
+	var body struct {
+		Role users.Role `json:"role"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Request must be JSON"})
+	}
+	if !body.Role.Valid() {
+		return c.Status(400).JSON(fiber.Map{"error": "Role must be viewer, operator or admin"})
+	}
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	user, exists := userStore.Get(name)
+	if !exists {
+		return c.Status(404).JSON(fiber.Map{"success": false, "message": "User " + name + " not found"})
+	}
+	if user.Role == users.Admin && body.Role != users.Admin && userStore.CountRole(users.Admin) == 1 {
+		return c.Status(409).JSON(fiber.Map{"success": false, "message": "Cannot demote the last admin"})
+	}
+
+	if _, err := userStore.Update(name, func(u *users.User) { u.Role = body.Role }); err != nil {
+		return c.Status(500).JSON(fiber.Map{"success": false, "message": err.Error()})
+	}
+	log.Printf("👤 User %s changed to %s by %s", name, body.Role, currentUser(c))
+	return c.JSON(fiber.Map{"success": true, "username": name, "role": body.Role})
+}
+
+// DeleteUser removes a user and ends their sessions
+func DeleteUser(c *fiber.Ctx) error {
+	name := c.Params("name")
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	user, exists := userStore.Get(name)
+	if !exists {
+		return c.Status(404).JSON(fiber.Map{"success": false, "message": "User " + name + " not found"})
+	}
+	if user.Role == users.Admin && userStore.CountRole(users.Admin) == 1 {
+		return c.Status(409).JSON(fiber.Map{"success": false, "message": "Cannot delete the last admin"})
+	}
+
+	if err := userStore.Delete(name); err != nil {
+		return c.Status(500).JSON(fiber.Map{"success": false, "message": err.Error()})
+	}
+	if err := sessions.DeleteUser(name); err != nil {
+		log.Println("Failed to clear sessions:", err)
+	}
+	log.Printf("👤 User %s deleted by %s", name, currentUser(c))
+	return c.JSON(fiber.Map{"success": true, "message": "User " + name + " deleted"})
+}
+
+// ResetUserTOTP gives a user a new TOTP secret, e.g. after they lost their
+// phone, and ends their sessions. Admins rotate their own secret through
+// RegenerateTOTP instead, which keeps the old one until the new one works.
+func ResetUserTOTP(c *fiber.Ctx) error {
+	name := c.Params("name")
+	if name == currentUser(c) {
+		return c.Status(409).JSON(fiber.Map{
+			"success": false,
+			"message": "Use /api/auth/regenerate to replace your own TOTP secret",
+		})
+	}
+	results, err := resetTOTP(name)
+	if errors.Is(err, users.ErrNotFound) {
+		return c.Status(404).JSON(fiber.Map{"success": false, "message": "User " + name + " not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"success": false, "message": err.Error()})
+	}
+
+	log.Printf("🔐 TOTP secret of %s reset by %s", name, currentUser(c))
+	results["success"] = true
+	results["message"] = "TOTP secret reset. Scan the QR code with the user's authenticator app."
+	return c.JSON(results)
+}
@@ -0,0 +1,319 @@
+package jobs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"piControlHelper/utils"
+)
+
+type Status string
+
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+)
+
+// maxOutput is the output kept per job. Once a job has written twice that,
+// the oldest lines are dropped down to it; the end of the output is what
+// usually says what went wrong.
+const maxOutput = 1 << 20
+
+// Func is the work a job performs. Anything written through the job's
+// RunCommand or Log ends up in the job output.
+type Func func(j *Job) (any, error)
+
+// Job is a unit of work running in the background.
+type Job struct {
+	id       string
+	kind     string
+	resource string
+
+	mu         sync.Mutex
+	status     Status
+	output     []byte
+	dropped    int
+	result     any
+	err        error
+	exitCode   int
+	createdAt  time.Time
+	startedAt  time.Time
+	finishedAt time.Time
+}
+
+// Snapshot is the JSON view of a job at one point in time.
+type Snapshot struct {
+	ID         string     `json:"id"`
+	Kind       string     `json:"kind"`
+	Resource   string     `json:"resource"`
+	Status     Status     `json:"status"`
+	Output     string     `json:"output"`
+	ExitCode   *int       `json:"exit_code,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Result     any        `json:"result,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+func (j *Job) ID() string {
+	return j.id
+}
+
+// Log appends a line to the job output.
+func (j *Job) Log(line string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.output = append(j.output, line...)
+	j.output = append(j.output, '\n')
+	if len(j.output) > 2*maxOutput {
+		cut := len(j.output) - maxOutput
+		if i := bytes.IndexByte(j.output[cut:], '\n'); i >= 0 {
+			cut += i + 1
+		}
+		j.dropped += cut
+		j.output = append([]byte(nil), j.output[cut:]...)
+	}
+}
+
+// outputString returns the output, noting how much was dropped. The caller
+// holds j.mu.
+func (j *Job) outputString() string {
+	if j.dropped == 0 {
+		return string(j.output)
+	}
+	return "... (" + strconv.Itoa(j.dropped) + " bytes dropped)\n" + string(j.output)
+}
+
+// RunCommand has the same signature as utils.RunCommand but also records
+// every output line on the job while the command runs.
+func (j *Job) RunCommand(name string, args ...string) (string, string, error) {
+	return utils.StreamCommand(func(_, line string) { j.Log(line) }, name, args...)
+}
+
+func (j *Job) Snapshot() Snapshot {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	snap := Snapshot{
+		ID:        j.id,
+		Kind:      j.kind,
+		Resource:  j.resource,
+		Status:    j.status,
+		Output:    j.outputString(),
+		Result:    j.result,
+		CreatedAt: j.createdAt,
+	}
+	if !j.startedAt.IsZero() {
+		startedAt := j.startedAt
+		snap.StartedAt = &startedAt
+	}
+	if !j.finishedAt.IsZero() {
+		finishedAt := j.finishedAt
+		exitCode := j.exitCode
+		snap.FinishedAt = &finishedAt
+		snap.ExitCode = &exitCode
+	}
+	if j.err != nil {
+		snap.Error = j.err.Error()
+	}
+	return snap
+}
+
+func (j *Job) finished() (bool, time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return !j.finishedAt.IsZero(), j.finishedAt
+}
+
+// Manager runs jobs in the background, one at a time per resource, and
+// forgets finished jobs once they are older than the retention period.
+type Manager struct {
+	retention time.Duration
+
+	mu       sync.Mutex
+	jobs     map[string]*Job
+	queues   map[string]*queue
+	onFinish []func(Snapshot)
+}
+
+// queue hands a resource to jobs and synchronous handlers in the order they
+// asked for it. The first waiter holds the resource.
+type queue struct {
+	waiters []chan struct{}
+}
+
+func NewManager(retention time.Duration) *Manager {
+	m := &Manager{
+		retention: retention,
+		jobs:      make(map[string]*Job),
+		queues:    make(map[string]*queue),
+	}
+	go m.janitor()
+	return m
+}
+
+// Lock blocks until the resource is free and returns its unlock function.
+// Synchronous handlers use it so they queue behind background jobs.
+func (m *Manager) Lock(resource string) func() {
+	turn, unlock := m.enqueue(resource)
+	<-turn
+	return unlock
+}
+
+// enqueue adds a waiter to the resource's queue. turn is closed once the
+// waiter holds the resource; unlock passes it on to the next one.
+func (m *Manager) enqueue(resource string) (turn <-chan struct{}, unlock func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q, ok := m.queues[resource]
+	if !ok {
+		q = &queue{}
+		m.queues[resource] = q
+	}
+	ch := make(chan struct{})
+	q.waiters = append(q.waiters, ch)
+	if len(q.waiters) == 1 {
+		close(ch)
+	}
+
+	var once sync.Once
+	return ch, func() { once.Do(func() { m.dequeue(resource) }) }
+}
+
+func (m *Manager) dequeue(resource string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.queues[resource]
+	q.waiters = q.waiters[1:]
+	if len(q.waiters) == 0 {
+		delete(m.queues, resource)
+		return
+	}
+	close(q.waiters[0])
+}
+
+// Submit queues fn to run once resource is free and returns immediately.
+// Jobs on the same resource run in the order they were submitted.
+func (m *Manager) Submit(kind, resource string, fn Func) *Job {
+	job := &Job{
+		id:        newJobID(),
+		kind:      kind,
+		resource:  resource,
+		status:    StatusQueued,
+		createdAt: time.Now(),
+	}
+
+	m.mu.Lock()
+	m.jobs[job.id] = job
+	m.mu.Unlock()
+
+	turn, unlock := m.enqueue(resource)
+	go m.run(job, fn, turn, unlock)
+	return job
+}
+
+// OnFinish registers fn to be called with the final snapshot of every job
+// that finishes from now on. fn runs on the job's goroutine.
+func (m *Manager) OnFinish(fn func(Snapshot)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onFinish = append(m.onFinish, fn)
+}
+
+func (m *Manager) run(job *Job, fn Func, turn <-chan struct{}, unlock func()) {
+	<-turn
+	defer unlock()
+
+	job.mu.Lock()
+	job.status = StatusRunning
+	job.startedAt = time.Now()
+	job.mu.Unlock()
+
+	result, err := fn(job)
+	job.finish(result, err)
+
+	m.mu.Lock()
+	hooks := m.onFinish
+	m.mu.Unlock()
+	for _, hook := range hooks {
+		hook(job.Snapshot())
+	}
+}
+
+func (j *Job) finish(result any, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.result = result
+	j.err = err
+	j.finishedAt = time.Now()
+	j.status = StatusSucceeded
+	if err != nil {
+		j.status = StatusFailed
+		j.exitCode = 1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			j.exitCode = exitErr.ExitCode()
+		}
+	}
+}
+
+func (m *Manager) Get(id string) (*Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	return job, ok
+}
+
+// List returns snapshots of every retained job, newest first.
+func (m *Manager) List() []Snapshot {
+	m.mu.Lock()
+	all := make([]*Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		all = append(all, job)
+	}
+	m.mu.Unlock()
+
+	snaps := make([]Snapshot, 0, len(all))
+	for _, job := range all {
+		snaps = append(snaps, job.Snapshot())
+	}
+	sort.Slice(snaps, func(i, k int) bool {
+		return snaps[i].CreatedAt.After(snaps[k].CreatedAt)
+	})
+	return snaps
+}
+
+func (m *Manager) janitor() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.cleanup()
+	}
+}
+
+func (m *Manager) cleanup() {
+	cutoff := time.Now().Add(-m.retention)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, job := range m.jobs {
+		if done, at := job.finished(); done && at.Before(cutoff) {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -1,51 +1,235 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"log"
+	"path/filepath"
+	"time"
 
+	"piControlHelper/apitoken"
+	"piControlHelper/certs"
+	"piControlHelper/config"
 	"piControlHelper/handlers"
+	"piControlHelper/users"
 	"piControlHelper/utils"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
 )
 
 func main() {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
 	// Initialize TOTP authentication
 	if err := handlers.InitializeAuth(); err != nil {
 		log.Fatalf("Failed to initialize authentication: %v", err)
 	}
 
-	app := fiber.New()
+	// API tokens for automation
+	if err := handlers.InitializeAPITokens(); err != nil {
+		log.Fatalf("Failed to initialize API tokens: %v", err)
+	}
+
+	// Login sessions, kept across restarts by default
+	if err := handlers.InitializeSessions(cfg.SessionStore, time.Duration(cfg.SessionIdleTimeout), time.Duration(cfg.SessionMaxLifetime)); err != nil {
+		log.Fatalf("Failed to initialize sessions: %v", err)
+	}
+
+	// Lockout after wrong TOTP codes
+	handlers.InitializeAuthLimiter(cfg.AuthLockout)
+
+	// Background jobs for long-running operations
+	handlers.InitializeJobs(time.Duration(cfg.JobRetention))
+
+	// Audit log of logins and privileged actions
+	if err := handlers.InitializeAudit(cfg.Audit); err != nil {
+		log.Fatalf("Failed to initialize audit log: %v", err)
+	}
+
+	// Package file uploads, the only large request bodies
+	handlers.InitializeUploads(cfg.MaxUploadSize)
+
+	// Package search index, refreshed in the background
+	handlers.InitializeIndex(time.Duration(cfg.IndexRefreshInterval), time.Duration(cfg.PackageListsMaxAge))
+
+	// HTTPS, with a self-signed certificate unless one is configured
+	var tlsConfig *tls.Config
+	tlsStatus := fiber.Map{"enabled": false}
+	if cfg.TLS.Enabled {
+		tlsConfig, err = loadTLS(cfg.TLS)
+		if err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+		// Clients pin the public key, since the certificate is usually
+		// self-signed
+		fingerprint := certs.Fingerprint(tlsConfig.Certificates[0])
+		publicKey := certs.PublicKeyFingerprint(tlsConfig.Certificates[0])
+		log.Println("🔒 TLS certificate SHA-256 fingerprint:", fingerprint)
+		log.Println("🔒 TLS public key SHA-256 fingerprint:", publicKey)
+		tlsStatus = fiber.Map{
+			"enabled":            true,
+			"fingerprint_sha256": fingerprint,
+			"public_key_sha256":  publicKey,
+			"client_auth":        tlsConfig.ClientCAs != nil,
+		}
+	}
+
+	app := fiber.New(appConfig(cfg))
+	app.Use(handlers.LimitBody(fiber.DefaultBodyLimit))
 
 	// Public endpoints (no authentication required)
 	app.Get("/status", func(c *fiber.Ctx) error {
 		distro := utils.IdentifyDistro()
-		return c.JSON(fiber.Map{"status": "running", "distribution": distro})
+		return c.JSON(fiber.Map{"status": "running", "distribution": distro, "tls": tlsStatus})
 	})
 
 	// Authentication endpoints
-	app.Post("/auth", handlers.AuthenticateHandler)
+	app.Post("/auth", handlers.Audit("auth.login"), handlers.AuthenticateHandler)
+	app.Post("/auth/refresh", handlers.Audit("auth.refresh"), handlers.RefreshHandler)
 	app.Get("/auth/status", handlers.GetAuthStatus)
 
-	// Protected API group (requires authentication)
+	// Protected API group (requires authentication). Every route needs a
+	// role from users and a scope from API tokens; routes without a scope
+	// are for users only.
 	api := app.Group("/api", handlers.AuthMiddleware)
+	readPackages := handlers.Require(users.Viewer, apitoken.PackagesRead)
+	writePackages := handlers.Require(users.Admin, apitoken.PackagesWrite)
+	applyUpdates := handlers.Require(users.Admin, apitoken.UpdatesApply)
+	readServices := handlers.Require(users.Viewer, apitoken.ServicesRead)
+	controlServices := handlers.Require(users.Operator, apitoken.ServicesControl)
+	writeUnits := handlers.Require(users.Admin, apitoken.UnitsWrite)
+	readJobs := handlers.Require(users.Viewer, apitoken.JobsRead)
+	readAudit := handlers.Require(users.Admin, apitoken.AuditRead)
+	user := handlers.Require(users.Viewer, "")
+	admin := handlers.Require(users.Admin, "")
 
 	// Package management endpoints
-	api.Post("/install", handlers.InstallPackages)
-	api.Post("/uninstall", handlers.UninstallPackages)
-	api.Get("/search", handlers.SearchPackages)
-	api.Get("/list_installed", handlers.ListInstalledPackages)
+	api.Post("/install", handlers.Audit("package.install"), writePackages, handlers.InstallPackages)
+	api.Post("/install/file", handlers.Audit("package.install_file"), writePackages, handlers.InstallPackageFiles)
+	api.Post("/uninstall", handlers.Audit("package.uninstall"), writePackages, handlers.UninstallPackages)
+	api.Post("/hold", handlers.Audit("package.hold"), writePackages, handlers.HoldPackages)
+	api.Post("/unhold", handlers.Audit("package.unhold"), writePackages, handlers.UnholdPackages)
+	api.Get("/held", readPackages, handlers.ListHeldPackages)
+	api.Get("/search", readPackages, handlers.SearchPackages)
+	api.Get("/list_installed", readPackages, handlers.ListInstalledPackages)
+	api.Get("/package", readPackages, handlers.PackageInfo)
+	api.Post("/refresh", handlers.Audit("package.refresh"), applyUpdates, handlers.RefreshPackageLists)
+	api.Get("/index", readPackages, handlers.IndexStatus)
+	api.Get("/updates", readPackages, handlers.ListUpdates)
+	api.Post("/upgrade", handlers.Audit("package.upgrade"), applyUpdates, handlers.UpgradePackages)
+
+	// Package repository endpoints
+	api.Get("/repos", readPackages, handlers.ListRepositories)
+	api.Post("/repos", handlers.Audit("repo.add"), writePackages, handlers.AddRepository)
+	api.Post("/repos/control", handlers.Audit("repo.control"), writePackages, handlers.ControlRepository)
+
+	// Streaming install/uninstall progress over WebSocket
+	api.Use("/packages/stream", func(c *fiber.Ctx) error {
+		if websocket.IsWebSocketUpgrade(c) {
+			return c.Next()
+		}
+		return fiber.ErrUpgradeRequired
+	})
+	api.Get("/packages/stream", writePackages, websocket.New(handlers.StreamPackages))
 
 	// Service management endpoints
-	api.Get("/services", handlers.ListServices)
-	api.Get("/service/status", handlers.ServiceStatus)
-	api.Post("/service/control", handlers.ControlService)
+	api.Get("/services", readServices, handlers.ListServices)
+	api.Get("/services/files", readServices, handlers.ListUnitFiles)
+	api.Get("/service/status", readServices, handlers.ServiceStatus)
+	api.Get("/service/logs", readServices, handlers.ServiceLogs)
+	api.Use("/service/logs/stream", func(c *fiber.Ctx) error {
+		if websocket.IsWebSocketUpgrade(c) {
+			return c.Next()
+		}
+		return fiber.ErrUpgradeRequired
+	})
+	api.Get("/service/logs/stream", readServices, websocket.New(handlers.StreamServiceLogs))
+	api.Post("/service/control", handlers.Audit("service.control"), controlServices, handlers.ControlService)
+	// Unit files can run any command as root, like packages
+	api.Get("/units/file", readServices, handlers.ReadUnitFile)
+	api.Post("/units/file", handlers.Audit("unit.write"), writeUnits, handlers.WriteUnitFile)
+	api.Delete("/units/file", handlers.Audit("unit.delete"), writeUnits, handlers.DeleteUnitFile)
+
+	// Background job endpoints
+	api.Get("/jobs", readJobs, handlers.ListJobs)
+	api.Get("/jobs/:id", readJobs, handlers.GetJob)
+
+	// Audit log endpoint
+	api.Get("/audit", readAudit, handlers.GetAuditLog)
 
 	// Authentication management endpoints
-	api.Get("/auth/session", handlers.GetSessionStatus)
-	api.Post("/auth/regenerate", handlers.RegenerateTOTP)
-	api.Post("/auth/logout", handlers.LogoutHandler)
+	api.Get("/auth/session", user, handlers.GetSessionStatus)
+	api.Post("/auth/regenerate", handlers.Audit("auth.regenerate"), admin, handlers.RegenerateTOTP)
+	api.Post("/auth/regenerate/confirm", handlers.Audit("auth.regenerate_confirm"), admin, handlers.ConfirmTOTP)
+	api.Post("/auth/logout", handlers.Audit("auth.logout"), user, handlers.LogoutHandler)
+
+	// User management endpoints
+	api.Get("/users", admin, handlers.ListUsers)
+	api.Post("/users", handlers.Audit("user.create"), admin, handlers.CreateUser)
+	api.Put("/users/:name", handlers.Audit("user.update"), admin, handlers.UpdateUser)
+	api.Delete("/users/:name", handlers.Audit("user.delete"), admin, handlers.DeleteUser)
+	api.Post("/users/:name/totp", handlers.Audit("user.reset_totp"), admin, handlers.ResetUserTOTP)
+
+	// API token endpoints
+	api.Get("/tokens", admin, handlers.ListAPITokens)
+	api.Post("/tokens", handlers.Audit("token.create"), admin, handlers.CreateAPIToken)
+	api.Delete("/tokens/:id", handlers.Audit("token.revoke"), admin, handlers.RevokeAPIToken)
 
 	log.Println("Starting PiControl Helper on distribution:", utils.IdentifyDistro())
-	log.Fatal(app.Listen(":8220"))
+	if tlsConfig == nil {
+		log.Println("⚠️ TLS is turned off, serving plain HTTP")
+		log.Fatal(app.Listen(":8220"))
+	}
+	ln, err := tls.Listen("tcp", ":8220", tlsConfig)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	log.Fatal(app.Listener(ln))
+}
+
+// appConfig returns the Fiber settings for cfg.
+func appConfig(cfg config.Config) fiber.Config {
+	fiberConfig := fiber.Config{
+		// Bodies past Fiber's default limit stay on the connection, so
+		// uploads are streamed to disk rather than read into memory.
+		// Multipart forms are only parsed once a handler asks for them,
+		// after authentication. LimitBody enforces the limit instead.
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+	}
+	if len(cfg.TrustedProxies) > 0 {
+		// c.IP() then returns the client behind the proxy, so the auth
+		// lockout applies per client. X-Forwarded-For is only read from
+		// the trusted proxies, which must set it rather than append to it:
+		// c.IP() is its first address.
+		fiberConfig.ProxyHeader = fiber.HeaderXForwardedFor
+		fiberConfig.EnableTrustedProxyCheck = true
+		fiberConfig.TrustedProxies = cfg.TrustedProxies
+		fiberConfig.EnableIPValidation = true
+	}
+	return fiberConfig
+}
+
+// loadTLS returns the listener's TLS configuration, generating a self-signed
+// certificate on first start if none is configured.
+func loadTLS(cfg config.TLS) (*tls.Config, error) {
+	certFile, keyFile := cfg.CertFile, cfg.KeyFile
+	if certFile == "" && keyFile == "" {
+		certFile = filepath.Join(config.Dir, "tls_cert.pem")
+		keyFile = filepath.Join(config.Dir, "tls_key.pem")
+		generated, err := certs.EnsureSelfSigned(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if generated {
+			log.Println("🔒 Generated self-signed TLS certificate for this host's addresses:", certFile)
+		}
+	} else if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls cert_file and key_file must be set together")
+	}
+	return certs.ServerConfig(certFile, keyFile, cfg.ClientCAFile)
 }
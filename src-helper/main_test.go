@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"piControlHelper/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// lockoutKey returns the address the auth lockout counts a request against,
+// for a request arriving from app.Test's remote address 0.0.0.0.
+func lockoutKey(t *testing.T, trustedProxies []string, forwardedFor string) string {
+	t.Helper()
+	cfg := config.Default()
+	cfg.TrustedProxies = trustedProxies
+	app := fiber.New(appConfig(cfg))
+	app.Get("/ip", func(c *fiber.Ctx) error {
+		return c.SendString(c.IP())
+	})
+
+	req := httptest.NewRequest("GET", "/ip", nil)
+	if forwardedFor != "" {
+		req.Header.Set(fiber.HeaderXForwardedFor, forwardedFor)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestSpoofedForwardedForKeepsLockoutKey(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies []string
+		forwardedFor   string
+		want           string
+	}{
+		{"no proxies configured", nil, "203.0.113.7", "0.0.0.0"},
+		{"sender is not a trusted proxy", []string{"192.0.2.1"}, "203.0.113.7", "0.0.0.0"},
+		{"trusted proxy sets the client", []string{"0.0.0.0"}, "198.51.100.4", "198.51.100.4"},
+		{"trusted proxy without header", []string{"0.0.0.0"}, "", "0.0.0.0"},
+		{"invalid address is ignored", []string{"0.0.0.0"}, "not-an-ip, 198.51.100.4", "198.51.100.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lockoutKey(t, tt.trustedProxies, tt.forwardedFor); got != tt.want {
+				t.Errorf("lockout key = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
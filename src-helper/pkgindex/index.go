@@ -0,0 +1,220 @@
+// Package pkgindex keeps the available packages in memory so searches are
+// answered without running the package manager.
+package pkgindex
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"piControlHelper/pkgmgr"
+)
+
+// Status describes the index and the last refresh.
+type Status struct {
+	Ready      bool `json:"ready"`
+	Refreshing bool `json:"refreshing"`
+	Packages   int  `json:"packages"`
+	// BuiltAt is when the index was last rebuilt successfully.
+	BuiltAt *time.Time `json:"built_at,omitempty"`
+	// ListsUpdatedAt is when the helper last refreshed the package lists.
+	ListsUpdatedAt *time.Time `json:"lists_updated_at,omitempty"`
+	Stale          bool       `json:"stale"`
+	// LastRefreshAt is when the most recent refresh or rebuild finished.
+	LastRefreshAt *time.Time `json:"last_refresh_at,omitempty"`
+	// Success is false while either the last list refresh or the last
+	// rebuild failed.
+	Success bool `json:"success"`
+	// ListsError is the error of the last package list refresh.
+	ListsError string `json:"lists_error,omitempty"`
+	// BuildError is the error of the last index rebuild.
+	BuildError string `json:"build_error,omitempty"`
+}
+
+// Index holds every available package of the native package manager.
+type Index struct {
+	maxAge time.Duration
+
+	mu           sync.RWMutex
+	packages     []pkgmgr.SearchResult
+	refreshing   int
+	builtAt      time.Time
+	listsUpdated time.Time
+	lastRefresh  time.Time
+	// listsErr and buildErr are kept apart, so a successful rebuild doesn't
+	// hide the failed list refresh before it
+	listsErr error
+	buildErr error
+}
+
+// New returns an empty index. Package lists older than maxAge are stale.
+func New(maxAge time.Duration) *Index {
+	return &Index{maxAge: maxAge}
+}
+
+func (ix *Index) begin() {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.refreshing++
+}
+
+// finish ends a refresh or rebuild, storing its error in target. The caller
+// doesn't hold ix.mu.
+func (ix *Index) finish(target *error, err error) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.refreshing--
+	ix.lastRefresh = time.Now()
+	*target = err
+}
+
+// Stale reports whether the package lists should be refreshed before use.
+// Lists the helper hasn't refreshed since it started count as stale.
+func (ix *Index) Stale() bool {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.listsUpdated.IsZero() || time.Since(ix.listsUpdated) > ix.maxAge
+}
+
+// RefreshLists refreshes the package lists (e.g. apt-get update). The caller
+// holds the package manager lock.
+func (ix *Index) RefreshLists(pm pkgmgr.PackageManager) error {
+	ix.begin()
+	err := pm.Refresh()
+	if err == nil {
+		ix.mu.Lock()
+		ix.listsUpdated = time.Now()
+		ix.mu.Unlock()
+	}
+	ix.finish(&ix.listsErr, err)
+	return err
+}
+
+// RefreshListsIfStale refreshes the package lists only when they are stale.
+func (ix *Index) RefreshListsIfStale(pm pkgmgr.PackageManager) error {
+	if !ix.Stale() {
+		return nil
+	}
+	return ix.RefreshLists(pm)
+}
+
+// Rebuild reloads the index from the local package lists. On failure the
+// previous index stays in place.
+func (ix *Index) Rebuild(pm pkgmgr.PackageManager) error {
+	ix.begin()
+	packages, err := pm.ListAvailable()
+	if err == nil {
+		ix.mu.Lock()
+		ix.packages = packages
+		ix.builtAt = time.Now()
+		ix.mu.Unlock()
+	}
+	ix.finish(&ix.buildErr, err)
+	return err
+}
+
+// Ready reports whether the index has been built at least once.
+func (ix *Index) Ready() bool {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return !ix.builtAt.IsZero()
+}
+
+func (ix *Index) Status() Status {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	status := Status{
+		Ready:      !ix.builtAt.IsZero(),
+		Refreshing: ix.refreshing > 0,
+		Packages:   len(ix.packages),
+		Stale:      ix.listsUpdated.IsZero() || time.Since(ix.listsUpdated) > ix.maxAge,
+		Success:    ix.listsErr == nil && ix.buildErr == nil,
+	}
+	if !ix.builtAt.IsZero() {
+		builtAt := ix.builtAt
+		status.BuiltAt = &builtAt
+	}
+	if !ix.listsUpdated.IsZero() {
+		listsUpdated := ix.listsUpdated
+		status.ListsUpdatedAt = &listsUpdated
+	}
+	if !ix.lastRefresh.IsZero() {
+		lastRefresh := ix.lastRefresh
+		status.LastRefreshAt = &lastRefresh
+	}
+	if ix.listsErr != nil {
+		status.ListsError = ix.listsErr.Error()
+	}
+	if ix.buildErr != nil {
+		status.BuildError = ix.buildErr.Error()
+	}
+	return status
+}
+
+// Search returns packages matching every word of query, best matches first.
+// A limit of 0 returns all matches.
+func (ix *Index) Search(query string, limit int) []pkgmgr.SearchResult {
+	terms := strings.Fields(strings.ToLower(query))
+
+	type match struct {
+		pkg   pkgmgr.SearchResult
+		score int
+	}
+	var matches []match
+	ix.mu.RLock()
+	for _, pkg := range ix.packages {
+		if s := score(pkg, terms); s > 0 {
+			matches = append(matches, match{pkg, s})
+		}
+	}
+	ix.mu.RUnlock()
+
+	sort.Slice(matches, func(i, k int) bool {
+		a, b := matches[i], matches[k]
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		if len(a.pkg.Name) != len(b.pkg.Name) {
+			return len(a.pkg.Name) < len(b.pkg.Name)
+		}
+		return a.pkg.Name < b.pkg.Name
+	})
+
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	results := make([]pkgmgr.SearchResult, len(matches))
+	for i, m := range matches {
+		results[i] = m.pkg
+	}
+	return results
+}
+
+// score ranks name matches above description matches, and exact names and
+// prefixes above substrings. It returns 0 unless every term matches.
+func score(pkg pkgmgr.SearchResult, terms []string) int {
+	if len(terms) == 0 {
+		return 0
+	}
+	name := strings.ToLower(pkg.Name)
+	desc := strings.ToLower(pkg.Description)
+
+	total := 0
+	for _, term := range terms {
+		switch {
+		case name == term:
+			total += 100
+		case strings.HasPrefix(name, term):
+			total += 60
+		case strings.Contains(name, term):
+			total += 40
+		case strings.Contains(desc, term):
+			total += 10
+		default:
+			return 0
+		}
+	}
+	return total
+}
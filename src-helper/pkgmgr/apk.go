@@ -0,0 +1,218 @@
+package pkgmgr
+
+import (
+	"strings"
+)
+
+// apk backs Alpine Linux.
+type apk struct {
+	run Runner
+}
+
+func init() {
+	register("alpine", func(run Runner) PackageManager { return &apk{run: run} })
+}
+
+func (a *apk) Name() string {
+	return "apk"
+}
+
+func (a *apk) Refresh() error {
+	_, err := a.run.run("sudo", "apk", "update")
+	return err
+}
+
+func (a *apk) Install(pkg string) (string, error) {
+	return a.run.run("sudo", "apk", "add", pkg)
+}
+
+func (a *apk) Versioned(pkg, version string) string {
+	return pkg + "=" + version
+}
+
+func (a *apk) InstallFile(path string) (string, error) {
+	if err := checkPackageFile(a.Name(), path, ".apk"); err != nil {
+		return "", err
+	}
+	// Internal builds aren't signed with a key in /etc/apk/keys
+	return a.run.run("sudo", "apk", "add", "--allow-untrusted", path)
+}
+
+func (a *apk) Remove(pkg string) (string, error) {
+	return a.run.run("sudo", "apk", "del", pkg)
+}
+
+func (a *apk) SimulateInstall(pkgs ...string) (*Transaction, error) {
+	return a.simulate("add", pkgs)
+}
+
+func (a *apk) SimulateRemove(pkgs ...string) (*Transaction, error) {
+	return a.simulate("del", pkgs)
+}
+
+// simulate runs apk with --simulate, which prints the steps it would take:
+//
+//	(1/2) Installing libnl3 (3.7.0-r0)
+//	(2/2) Upgrading htop (3.2.1-r0 -> 3.2.2-r0)
+//	(1/1) Purging htop (3.2.2-r0)
+//
+// apk doesn't report sizes in simulate mode.
+func (a *apk) simulate(action string, pkgs []string) (*Transaction, error) {
+	args := append([]string{"apk", action, "--simulate"}, pkgs...)
+	out, err := a.run.run("sudo", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := newTransaction()
+	for _, line := range lines(out) {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "(") {
+			continue
+		}
+		version := between(line, fields[2]+" (", ")")
+		if _, candidate, found := strings.Cut(version, " -> "); found {
+			version = candidate
+		}
+		pkg := TransactionPackage{Name: fields[2], Version: version}
+		switch fields[1] {
+		case "Installing":
+			tx.Install = append(tx.Install, pkg)
+		case "Upgrading", "Downgrading", "Replacing":
+			tx.Upgrade = append(tx.Upgrade, pkg)
+		case "Purging", "Deleting":
+			tx.Remove = append(tx.Remove, pkg)
+		}
+	}
+	return tx, nil
+}
+
+func (a *apk) Search(query string) ([]SearchResult, error) {
+	out, err := a.run.run("apk", "search", "-v", query)
+	if err != nil {
+		return nil, err
+	}
+
+	// apk search -v prints "name-1.2.3-r0 - description"
+	results := []SearchResult{}
+	for _, line := range lines(out) {
+		pkgver, desc, _ := strings.Cut(line, " - ")
+		name, _ := splitPkgver(strings.TrimSpace(pkgver), 2)
+		results = append(results, SearchResult{Name: name, Description: strings.TrimSpace(desc)})
+	}
+	return results, nil
+}
+
+// ListAvailable searches for "*", which apk matches as a glob.
+func (a *apk) ListAvailable() ([]SearchResult, error) {
+	return a.Search("*")
+}
+
+func (a *apk) ListInstalled() ([]InstalledPackage, error) {
+	out, err := a.run.run("apk", "info", "-v")
+	if err != nil {
+		return nil, err
+	}
+
+	packages := []InstalledPackage{}
+	for _, line := range lines(out) {
+		name, version := splitPkgver(strings.TrimSpace(line), 2)
+		packages = append(packages, InstalledPackage{Name: name, Version: version})
+	}
+	return packages, nil
+}
+
+func (a *apk) ListUpdates() ([]Update, error) {
+	out, err := a.run.run("apk", "version", "-l", "<")
+	if err != nil {
+		return nil, err
+	}
+
+	// apk version prints "name-1.0-r0  <  1.1-r0" after an "Installed:" header
+	updates := []Update{}
+	for _, line := range lines(out) {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "<" {
+			continue
+		}
+		name, current := splitPkgver(fields[0], 2)
+		updates = append(updates, Update{Name: name, CurrentVersion: current, CandidateVersion: fields[2]})
+	}
+	return updates, nil
+}
+
+func (a *apk) Upgrade(pkgs ...string) (string, error) {
+	args := append([]string{"apk", "upgrade"}, pkgs...)
+	return a.run.run("sudo", args...)
+}
+
+func (a *apk) Info(pkg string) (*PackageInfo, error) {
+	// apk search -e -v gives the candidate "name-version - description"
+	out, err := a.run.run("apk", "search", "-e", "-v", pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	found := lines(out)
+	if len(found) == 0 {
+		return nil, &CommandError{Err: ErrNotFound, Stderr: "package " + pkg + " not found"}
+	}
+	pkgver, desc, _ := strings.Cut(found[0], " - ")
+	name, version := splitPkgver(strings.TrimSpace(pkgver), 2)
+	info := &PackageInfo{
+		Name:        name,
+		Version:     version,
+		Description: strings.TrimSpace(desc),
+	}
+
+	if installed, err := a.run.run("apk", "info", "-e", "-v", pkg); err == nil {
+		_, info.InstalledVersion = splitPkgver(strings.TrimSpace(installed), 2)
+		info.Installed = true
+	}
+
+	// apk info prints each requested field as "<pkgver> <field>:" followed
+	// by its values, one per line, and a blank line.
+	sections := map[string][]string{}
+	if details, err := a.run.run("apk", "info", "-R", "-r", "-s", pkg); err == nil {
+		current := ""
+		for _, line := range lines(details) {
+			if strings.HasSuffix(line, ":") && strings.HasPrefix(line, name+"-") {
+				_, current, _ = strings.Cut(strings.TrimSuffix(line, ":"), " ")
+				continue
+			}
+			sections[current] = append(sections[current], strings.TrimSpace(line))
+		}
+	}
+	info.Dependencies = append([]string{}, sections["depends on"]...)
+	info.ReverseDependencies = append([]string{}, sections["is required by"]...)
+	if size := sections["installed size"]; len(size) > 0 {
+		info.InstalledSize = parseSize(size[0], 1)
+	}
+
+	if policy, err := a.run.run("apk", "policy", pkg); err == nil {
+		info.Repository = apkCandidateRepository(policy, version)
+	}
+	return info, nil
+}
+
+// apkCandidateRepository picks the repository providing version from apk
+// policy output, which lists repositories under each version:
+//
+//	nginx policy:
+//	  1.24.0-r6:
+//	    lib/apk/db/installed
+//	    https://dl-cdn.alpinelinux.org/alpine/v3.18/main
+func apkCandidateRepository(policy, version string) string {
+	inVersion := false
+	for _, line := range lines(policy) {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasSuffix(trimmed, ":") {
+			inVersion = strings.TrimSuffix(trimmed, ":") == version
+			continue
+		}
+		if inVersion && trimmed != "lib/apk/db/installed" {
+			return trimmed
+		}
+	}
+	return ""
+}
@@ -0,0 +1,524 @@
+package pkgmgr
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"piControlHelper/utils"
+)
+
+// apt backs Debian, Ubuntu, Raspberry Pi OS and their derivatives.
+type apt struct {
+	run Runner
+}
+
+func init() {
+	register("debian", func(run Runner) PackageManager { return &apt{run: run} })
+}
+
+func (a *apt) Name() string {
+	return "apt"
+}
+
+func (a *apt) Refresh() error {
+	_, err := a.run.run("sudo", "apt-get", "update")
+	return err
+}
+
+func (a *apt) Install(pkg string) (string, error) {
+	return a.run.run("sudo", "apt-get", "install", "-y", pkg)
+}
+
+func (a *apt) Versioned(pkg, version string) string {
+	return pkg + "=" + version
+}
+
+func (a *apt) InstallFile(path string) (string, error) {
+	if err := checkPackageFile(a.Name(), path, ".deb"); err != nil {
+		return "", err
+	}
+	// apt-get treats arguments containing a slash as files and resolves
+	// their dependencies from the repositories
+	return a.run.run("sudo", "apt-get", "install", "-y", path)
+}
+
+func (a *apt) Remove(pkg string) (string, error) {
+	return a.run.run("sudo", "apt-get", "remove", "-y", pkg)
+}
+
+func (a *apt) SimulateInstall(pkgs ...string) (*Transaction, error) {
+	return a.simulate("install", pkgs)
+}
+
+func (a *apt) SimulateRemove(pkgs ...string) (*Transaction, error) {
+	return a.simulate("remove", pkgs)
+}
+
+// simulate runs apt-get -s, which prints one line per action:
+//
+//	Inst libc6 [2.36-9] (2.36-9+deb12u4 Debian:12.5/stable [arm64])
+//	Inst htop (3.2.2-2 Debian:12.5/stable [arm64])
+//	Remv htop [3.2.2-2]
+//
+// apt-get -s doesn't print sizes, so they come from apt-cache and dpkg.
+func (a *apt) simulate(action string, pkgs []string) (*Transaction, error) {
+	args := append([]string{"-s", action}, pkgs...)
+	out, err := a.run.run("apt-get", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := newTransaction()
+	var fetched, replaced []string
+	for _, line := range lines(out) {
+		kind, rest, _ := strings.Cut(line, " ")
+		name, rest, _ := strings.Cut(rest, " ")
+		switch kind {
+		case "Inst":
+			pkg := TransactionPackage{Name: name, Version: between(rest, "(", " ")}
+			if strings.HasPrefix(rest, "[") {
+				tx.Upgrade = append(tx.Upgrade, pkg)
+				replaced = append(replaced, name)
+			} else {
+				tx.Install = append(tx.Install, pkg)
+			}
+			fetched = append(fetched, name)
+		case "Remv":
+			tx.Remove = append(tx.Remove, TransactionPackage{Name: name, Version: between(rest, "[", "]")})
+			replaced = append(replaced, name)
+		}
+	}
+
+	if len(fetched) > 0 {
+		show, _, _ := a.run("apt-cache", append([]string{"show", "--no-all-versions"}, fetched...)...)
+		for _, stanza := range strings.Split(show, "\n\n") {
+			fields := parseFields(stanza)
+			tx.DownloadSize += parseSize(fields["Size"], 1)
+			tx.DiskSize += parseSize(fields["Installed-Size"], 1<<10)
+		}
+	}
+	if len(replaced) > 0 {
+		sizes, _, _ := a.run("dpkg-query", append([]string{"-W", "-f=${Installed-Size}\n"}, replaced...)...)
+		for _, size := range lines(sizes) {
+			tx.DiskSize -= parseSize(size, 1<<10)
+		}
+	}
+	return tx, nil
+}
+
+func (a *apt) Search(query string) ([]SearchResult, error) {
+	out, err := a.run.run("apt-cache", "search", query)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []SearchResult{}
+	for _, line := range lines(out) {
+		name, desc, _ := strings.Cut(line, " - ")
+		results = append(results, SearchResult{Name: strings.TrimSpace(name), Description: strings.TrimSpace(desc)})
+	}
+	return results, nil
+}
+
+// ListAvailable searches for "." since apt-cache search takes a regex.
+func (a *apt) ListAvailable() ([]SearchResult, error) {
+	return a.Search(".")
+}
+
+func (a *apt) ListInstalled() ([]InstalledPackage, error) {
+	out, err := a.run.run("dpkg-query", "-W", "-f=${Package}\t${Version}\n")
+	if err != nil {
+		return nil, err
+	}
+
+	packages := []InstalledPackage{}
+	for _, line := range lines(out) {
+		name, version, _ := strings.Cut(line, "\t")
+		packages = append(packages, InstalledPackage{Name: name, Version: version})
+	}
+	return packages, nil
+}
+
+func (a *apt) ListUpdates() ([]Update, error) {
+	out, err := a.run.run("apt", "list", "--upgradable")
+	if err != nil {
+		return nil, err
+	}
+
+	// apt list prints "name/suite candidate arch [upgradable from: current]"
+	updates := []Update{}
+	for _, line := range lines(out) {
+		nameSuite, rest, found := strings.Cut(line, " ")
+		if !found || !strings.Contains(nameSuite, "/") {
+			continue
+		}
+		name, _, _ := strings.Cut(nameSuite, "/")
+		candidate, _, _ := strings.Cut(rest, " ")
+		current := ""
+		if _, from, ok := strings.Cut(rest, "upgradable from: "); ok {
+			current = strings.TrimSuffix(from, "]")
+		}
+		updates = append(updates, Update{Name: name, CurrentVersion: current, CandidateVersion: candidate})
+	}
+	return updates, nil
+}
+
+func (a *apt) Upgrade(pkgs ...string) (string, error) {
+	if len(pkgs) == 0 {
+		return a.run.run("sudo", "apt-get", "upgrade", "-y")
+	}
+	args := append([]string{"apt-get", "install", "--only-upgrade", "-y"}, pkgs...)
+	return a.run.run("sudo", args...)
+}
+
+func (a *apt) Hold(pkg string) (string, error) {
+	return a.run.run("sudo", "apt-mark", "hold", pkg)
+}
+
+func (a *apt) Unhold(pkg string) (string, error) {
+	return a.run.run("sudo", "apt-mark", "unhold", pkg)
+}
+
+func (a *apt) ListHeld() ([]string, error) {
+	out, err := a.run.run("apt-mark", "showhold")
+	if err != nil {
+		return nil, err
+	}
+	held := []string{}
+	for _, line := range lines(out) {
+		held = append(held, strings.TrimSpace(line))
+	}
+	return held, nil
+}
+
+func (a *apt) Info(pkg string) (*PackageInfo, error) {
+	out, err := a.run.run("apt-cache", "show", "--no-all-versions", pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := parseFields(out)
+	info := &PackageInfo{
+		Name:          fields["Package"],
+		Version:       fields["Version"],
+		Description:   fields["Description"],
+		DownloadSize:  parseSize(fields["Size"], 1),
+		InstalledSize: parseSize(fields["Installed-Size"], 1<<10),
+		Dependencies:  depList(fields["Depends"]+","+fields["Pre-Depends"], ","),
+	}
+
+	status, _, _ := a.run("dpkg-query", "-W", "-f=${Status}\t${Version}", pkg)
+	state, version, _ := strings.Cut(strings.TrimSpace(status), "\t")
+	if state == "install ok installed" {
+		info.Installed = true
+		info.InstalledVersion = version
+	}
+
+	if policy, err := a.run.run("apt-cache", "policy", pkg); err == nil {
+		info.Repository = aptCandidateRepository(policy)
+	}
+
+	info.ReverseDependencies = []string{}
+	if rdepends, err := a.run.run("apt-cache", "rdepends", "--installed", pkg); err == nil {
+		// The first two lines are the package name and "Reverse Depends:"
+		for _, line := range lines(rdepends) {
+			if !strings.HasPrefix(line, " ") {
+				continue
+			}
+			name := strings.TrimLeft(strings.TrimSpace(line), "|")
+			if !slices.Contains(info.ReverseDependencies, name) {
+				info.ReverseDependencies = append(info.ReverseDependencies, name)
+			}
+		}
+	}
+	return info, nil
+}
+
+// aptCandidateRepository picks the source of the candidate version from
+// apt-cache policy output:
+//
+//	Candidate: 3.2.2-2
+//	Version table:
+//	 *** 3.2.2-2 500
+//	        500 http://deb.debian.org/debian bookworm/main arm64 Packages
+func aptCandidateRepository(policy string) string {
+	candidate := ""
+	inCandidate := false
+	for _, line := range lines(policy) {
+		if version, found := strings.CutPrefix(strings.TrimSpace(line), "Candidate:"); found {
+			candidate = strings.TrimSpace(version)
+			continue
+		}
+		cols := strings.Fields(strings.TrimPrefix(strings.TrimSpace(line), "*** "))
+		if len(cols) == 2 {
+			inCandidate = cols[0] == candidate
+			continue
+		}
+		if inCandidate && len(cols) >= 3 {
+			return cols[1] + " " + cols[2]
+		}
+	}
+	return ""
+}
+
+var (
+	aptSourcesDir = "/etc/apt/sources.list.d"
+	aptKeyringDir = "/etc/apt/keyrings"
+)
+
+// ListRepositories lists the entries under sources.list.d, both one-line
+// .list files and deb822 .sources files. The distribution's own
+// /etc/apt/sources.list is left out so it can't be disabled by accident.
+func (a *apt) ListRepositories() ([]Repository, error) {
+	files, err := filepath.Glob(filepath.Join(aptSourcesDir, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	repos := []Repository{}
+	for _, file := range files {
+		ext := filepath.Ext(file)
+		if ext != ".list" && ext != ".sources" {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		repo := Repository{ID: strings.TrimSuffix(filepath.Base(file), ext), File: file, URLs: []string{}}
+		if ext == ".list" {
+			repo.URLs, repo.Enabled = parseAptList(string(data))
+		} else {
+			repo.URLs, repo.Enabled = parseAptSources(string(data))
+		}
+		repos = append(repos, repo)
+	}
+	return repos, nil
+}
+
+// parseAptList reads one-line entries such as
+// "deb [signed-by=/etc/apt/keyrings/docker.asc] https://download.docker.com/linux/debian bookworm stable".
+// Commented-out entries count as disabled.
+func parseAptList(data string) ([]string, bool) {
+	urls := []string{}
+	enabled := false
+	for _, line := range lines(data) {
+		trimmed := strings.TrimSpace(line)
+		active := !strings.HasPrefix(trimmed, "#")
+		fields := strings.Fields(strings.TrimLeft(trimmed, "# "))
+		if len(fields) < 2 || (fields[0] != "deb" && fields[0] != "deb-src") {
+			continue
+		}
+		fields = fields[1:]
+		if strings.HasPrefix(fields[0], "[") {
+			for len(fields) > 0 && !strings.HasSuffix(fields[0], "]") {
+				fields = fields[1:]
+			}
+			if len(fields) > 0 {
+				fields = fields[1:]
+			}
+		}
+		if len(fields) > 0 && !slices.Contains(urls, fields[0]) {
+			urls = append(urls, fields[0])
+		}
+		enabled = enabled || active
+	}
+	return urls, enabled
+}
+
+// parseAptSources reads deb822 stanzas, which are enabled unless they set
+// "Enabled: no".
+func parseAptSources(data string) ([]string, bool) {
+	urls := []string{}
+	enabled := false
+	for _, stanza := range strings.Split(data, "\n\n") {
+		fields := parseFields(stanza)
+		if fields["URIs"] == "" {
+			continue
+		}
+		for _, url := range strings.Fields(fields["URIs"]) {
+			if !slices.Contains(urls, url) {
+				urls = append(urls, url)
+			}
+		}
+		enabled = enabled || fields["Enabled"] != "no"
+	}
+	return urls, enabled
+}
+
+func (a *apt) AddRepository(spec RepositorySpec) (*Repository, error) {
+	if ppa, found := strings.CutPrefix(spec.URL, "ppa:"); found {
+		if err := resolvePPA(&spec, ppa); err != nil {
+			return nil, err
+		}
+	}
+	if spec.URL == "" || spec.Suite == "" {
+		return nil, errors.New("url and suite are required")
+	}
+	if err := validateRepository(spec.ID, append([]string{spec.URL, spec.Suite, spec.KeyURL}, spec.Components...)...); err != nil {
+		return nil, err
+	}
+	// Without a key apt still checks signatures, against the system keyring
+	if err := checkSigningKey(spec, false); err != nil {
+		return nil, err
+	}
+	if _, err := a.sourceFile(spec.ID); err == nil {
+		return nil, fmt.Errorf("repository %s already exists", spec.ID)
+	}
+
+	entry := []string{"deb"}
+	if spec.KeyURL != "" {
+		key, err := fetch(spec.KeyURL)
+		if err != nil {
+			return nil, err
+		}
+		// apt reads ASCII-armored keys directly when they end in .asc
+		keyring := filepath.Join(aptKeyringDir, spec.ID+".gpg")
+		if bytes.Contains(key, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")) {
+			keyring = filepath.Join(aptKeyringDir, spec.ID+".asc")
+		}
+		if err := utils.InstallFile(a.run, keyring, key); err != nil {
+			return nil, err
+		}
+		entry = append(entry, "[signed-by="+keyring+"]")
+	}
+	entry = append(entry, spec.URL, spec.Suite)
+	entry = append(entry, spec.Components...)
+
+	file := filepath.Join(aptSourcesDir, spec.ID+".list")
+	if err := utils.InstallFile(a.run, file, []byte(strings.Join(entry, " ")+"\n")); err != nil {
+		return nil, err
+	}
+	return &Repository{ID: spec.ID, URLs: []string{spec.URL}, Enabled: true, File: file}, nil
+}
+
+// resolvePPA fills in the Launchpad archive URL, the release codename and the
+// archive's signing key for "ppa:owner/name", the same way add-apt-repository
+// does.
+func resolvePPA(spec *RepositorySpec, ppa string) error {
+	owner, name, found := strings.Cut(ppa, "/")
+	if !found || owner == "" || name == "" {
+		return fmt.Errorf("invalid PPA %q, expected ppa:owner/name", ppa)
+	}
+	if err := validateRepository(owner + "-" + name); err != nil {
+		return err
+	}
+
+	release := utils.OSRelease()
+	codename := release["UBUNTU_CODENAME"]
+	if codename == "" && release["ID"] == "ubuntu" {
+		codename = release["VERSION_CODENAME"]
+	}
+	if codename == "" {
+		return errors.New("PPAs are only available on Ubuntu and its derivatives")
+	}
+
+	archive, err := fetch("https://api.launchpad.net/1.0/~" + owner + "/+archive/ubuntu/" + name)
+	if err != nil {
+		return err
+	}
+	var meta struct {
+		Fingerprint string `json:"signing_key_fingerprint"`
+	}
+	if err := json.Unmarshal(archive, &meta); err != nil || meta.Fingerprint == "" {
+		return fmt.Errorf("no signing key found for ppa:%s/%s", owner, name)
+	}
+
+	if spec.ID == "" {
+		spec.ID = owner + "-ubuntu-" + name
+	}
+	spec.URL = "https://ppa.launchpadcontent.net/" + owner + "/" + name + "/ubuntu"
+	spec.Suite = codename
+	spec.Components = []string{"main"}
+	spec.KeyURL = "https://keyserver.ubuntu.com/pks/lookup?op=get&options=mr&search=0x" + meta.Fingerprint
+	return nil
+}
+
+// sourceFile finds the .list or .sources file for a repository id.
+func (a *apt) sourceFile(id string) (string, error) {
+	if err := validateRepository(id); err != nil {
+		return "", err
+	}
+	for _, ext := range []string{".list", ".sources"} {
+		file := filepath.Join(aptSourcesDir, id+ext)
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
+	}
+	return "", ErrRepositoryNotFound
+}
+
+func (a *apt) SetRepositoryEnabled(id string, enabled bool) error {
+	file, err := a.sourceFile(id)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var updated string
+	if strings.HasSuffix(file, ".list") {
+		// Comment or uncomment every entry line, leaving other comments alone
+		fileLines := strings.Split(string(data), "\n")
+		for i, line := range fileLines {
+			trimmed := strings.TrimLeft(line, "# ")
+			if !strings.HasPrefix(trimmed, "deb ") && !strings.HasPrefix(trimmed, "deb-src ") {
+				continue
+			}
+			if enabled {
+				fileLines[i] = trimmed
+			} else {
+				fileLines[i] = "# " + trimmed
+			}
+		}
+		updated = strings.Join(fileLines, "\n")
+	} else {
+		value := "Enabled: no"
+		if enabled {
+			value = "Enabled: yes"
+		}
+		stanzas := strings.Split(string(data), "\n\n")
+		for i, stanza := range stanzas {
+			if parseFields(stanza)["URIs"] == "" {
+				continue
+			}
+			var kept []string
+			for _, line := range strings.Split(strings.TrimRight(stanza, "\n"), "\n") {
+				if !strings.HasPrefix(line, "Enabled:") {
+					kept = append(kept, line)
+				}
+			}
+			stanzas[i] = strings.Join(append(kept, value), "\n")
+		}
+		updated = strings.Join(stanzas, "\n\n")
+		if !strings.HasSuffix(updated, "\n") {
+			updated += "\n"
+		}
+	}
+	return utils.InstallFile(a.run, file, []byte(updated))
+}
+
+func (a *apt) RemoveRepository(id string) error {
+	file, err := a.sourceFile(id)
+	if err != nil {
+		return err
+	}
+	if err := removeFile(a.run, file); err != nil {
+		return err
+	}
+	// Keys added by AddRepository are named after the repository
+	for _, ext := range []string{".asc", ".gpg"} {
+		if err := removeFile(a.run, filepath.Join(aptKeyringDir, id+ext)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,530 @@
+package pkgmgr
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"piControlHelper/utils"
+)
+
+// dnf backs Fedora and other RPM distributions using dnf.
+type dnf struct {
+	run Runner
+}
+
+func init() {
+	register("fedora", func(run Runner) PackageManager { return &dnf{run: run} })
+}
+
+func (d *dnf) Name() string {
+	return "dnf"
+}
+
+// Refresh is a no-op: dnf refreshes expired metadata on its own.
+func (d *dnf) Refresh() error {
+	return nil
+}
+
+func (d *dnf) Install(pkg string) (string, error) {
+	return d.run.run("sudo", "dnf", "install", "-y", pkg)
+}
+
+func (d *dnf) Versioned(pkg, version string) string {
+	return pkg + "-" + version
+}
+
+func (d *dnf) InstallFile(path string) (string, error) {
+	if err := checkPackageFile(d.Name(), path, ".rpm"); err != nil {
+		return "", err
+	}
+	return d.run.run("sudo", "dnf", "install", "-y", path)
+}
+
+func (d *dnf) Remove(pkg string) (string, error) {
+	return d.run.run("sudo", "dnf", "remove", "-y", pkg)
+}
+
+func (d *dnf) SimulateInstall(pkgs ...string) (*Transaction, error) {
+	return d.simulate("install", pkgs)
+}
+
+func (d *dnf) SimulateRemove(pkgs ...string) (*Transaction, error) {
+	return d.simulate("remove", pkgs)
+}
+
+// simulate runs the real command with --assumeno, which prints the
+// transaction table and sizes and then aborts with exit status 1:
+//
+//	Installing:
+//	 htop        aarch64   3.3.0-1.fc39   updates   180 k
+//	Upgrading:
+//	 ...
+//	Total download size: 180 k
+//	Installed size: 420 k
+func (d *dnf) simulate(action string, pkgs []string) (*Transaction, error) {
+	args := append([]string{"dnf", action, "--assumeno"}, pkgs...)
+	out, err := d.run.run("sudo", args...)
+	if err != nil && !strings.Contains(out, "Transaction Summary") {
+		return nil, err
+	}
+
+	tx := newTransaction()
+	var section *[]TransactionPackage
+	for _, line := range lines(out) {
+		if !strings.HasPrefix(line, " ") {
+			switch {
+			case strings.HasPrefix(line, "Installing"), strings.HasPrefix(line, "Reinstalling"):
+				section = &tx.Install
+			case strings.HasPrefix(line, "Upgrading"), strings.HasPrefix(line, "Downgrading"):
+				section = &tx.Upgrade
+			case strings.HasPrefix(line, "Removing"):
+				section = &tx.Remove
+			default:
+				section = nil
+			}
+			if size, found := strings.CutPrefix(line, "Total download size:"); found {
+				tx.DownloadSize = parseSize(size, 1)
+			}
+			if size, found := strings.CutPrefix(line, "Installed size:"); found {
+				tx.DiskSize = parseSize(size, 1)
+			}
+			if size, found := strings.CutPrefix(line, "Freed space:"); found {
+				tx.DiskSize = -parseSize(size, 1)
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if section != nil && len(fields) >= 3 {
+			*section = append(*section, TransactionPackage{Name: fields[0], Version: fields[2]})
+		}
+	}
+	return tx, nil
+}
+
+func (d *dnf) Search(query string) ([]SearchResult, error) {
+	out, err := d.run.run("dnf", "search", query)
+	if err != nil {
+		return nil, err
+	}
+
+	// dnf search output lines generally look like: "name.arch : description"
+	results := []SearchResult{}
+	for _, line := range lines(out) {
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "=") || strings.HasPrefix(line, "Last metadata expiration check") {
+			continue
+		}
+		name, desc, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		results = append(results, SearchResult{Name: strings.TrimSpace(name), Description: strings.TrimSpace(desc)})
+	}
+	return results, nil
+}
+
+func (d *dnf) ListAvailable() ([]SearchResult, error) {
+	out, err := d.run.run("dnf", "-q", "repoquery", "--available", "--qf", "%{name}\t%{summary}\n")
+	if err != nil {
+		return nil, err
+	}
+
+	// repoquery lists every architecture, so names repeat
+	results := []SearchResult{}
+	seen := map[string]bool{}
+	for _, line := range lines(out) {
+		name, summary, _ := strings.Cut(line, "\t")
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		results = append(results, SearchResult{Name: name, Description: strings.TrimSpace(summary)})
+	}
+	return results, nil
+}
+
+func (d *dnf) ListInstalled() ([]InstalledPackage, error) {
+	return listRPM(d.run)
+}
+
+func (d *dnf) ListUpdates() ([]Update, error) {
+	out, err := d.run.run("dnf", "-q", "check-update")
+	// check-update exits with 100 when updates are available
+	if err != nil && exitCode(err) != 100 {
+		return nil, err
+	}
+
+	current := rpmVersions(d.run)
+	updates := []Update{}
+	for _, line := range lines(out) {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "Obsoleting") {
+			continue
+		}
+		name := fields[0]
+		if dot := strings.LastIndex(name, "."); dot > 0 {
+			name = name[:dot]
+		}
+		updates = append(updates, Update{Name: name, CurrentVersion: current[name], CandidateVersion: fields[1]})
+	}
+	return updates, nil
+}
+
+func (d *dnf) Upgrade(pkgs ...string) (string, error) {
+	args := append([]string{"dnf", "upgrade", "-y"}, pkgs...)
+	return d.run.run("sudo", args...)
+}
+
+// Hold uses the versionlock plugin, which is built into dnf 5 and packaged
+// as python3-dnf-plugin-versionlock for dnf 4.
+func (d *dnf) Hold(pkg string) (string, error) {
+	out, err := d.run.run("sudo", "dnf", "versionlock", "add", pkg)
+	return out, d.holdError(err)
+}
+
+func (d *dnf) Unhold(pkg string) (string, error) {
+	out, err := d.run.run("sudo", "dnf", "versionlock", "delete", pkg)
+	return out, d.holdError(err)
+}
+
+// checkHolds looks for the versionlock command. Without the plugin dnf 4
+// fails with "No such command" before printing the help.
+func (d *dnf) checkHolds() error {
+	if !d.run.succeeds("dnf", "versionlock", "--help") {
+		return fmt.Errorf("%w: dnf needs the versionlock plugin, install python3-dnf-plugin-versionlock (dnf-plugin-versionlock on older releases)", ErrHoldUnsupported)
+	}
+	return nil
+}
+
+// holdError explains a failed versionlock command by the missing plugin
+// when that is the cause.
+func (d *dnf) holdError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if unsupported := d.checkHolds(); unsupported != nil {
+		return unsupported
+	}
+	return err
+}
+
+func (d *dnf) ListHeld() ([]string, error) {
+	out, err := d.run.run("dnf", "-q", "versionlock", "list")
+	if err != nil {
+		return nil, d.holdError(err)
+	}
+
+	// dnf 4 prints "htop-0:3.3.0-1.fc39.*" while dnf 5 prints
+	// "Package name: htop" followed by the locked version.
+	held := []string{}
+	for _, line := range lines(out) {
+		line = strings.TrimSpace(line)
+		if name, found := strings.CutPrefix(line, "Package name:"); found {
+			held = append(held, strings.TrimSpace(name))
+			continue
+		}
+		if strings.ContainsAny(line, " #=") {
+			continue
+		}
+		name, _ := splitPkgver(strings.TrimSuffix(line, ".*"), 2)
+		held = append(held, name)
+	}
+	return held, nil
+}
+
+func (d *dnf) Info(pkg string) (*PackageInfo, error) {
+	out, err := d.run.run("dnf", "info", pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	// dnf info lists "Installed Packages" before "Available Packages"; the
+	// first block is what parseFields keeps, so prefer the available one.
+	available := out
+	if _, after, found := strings.Cut(out, "Available Packages"); found {
+		available = after
+	}
+	fields := parseFields(available)
+	info := &PackageInfo{
+		Name:         fields["Name"],
+		Version:      joinVersion(fields["Version"], fields["Release"]),
+		Description:  fields["Summary"],
+		Repository:   fields["Repository"],
+		DownloadSize: parseSize(fields["Size"], 1),
+		Dependencies: []string{},
+	}
+
+	if installed, err := d.run.run("rpm", "-q", "--qf", "%{VERSION}-%{RELEASE}\t%{SIZE}", pkg); err == nil {
+		version, size, _ := strings.Cut(strings.TrimSpace(installed), "\t")
+		info.Installed = true
+		info.InstalledVersion = version
+		info.InstalledSize = parseSize(size, 1)
+	}
+
+	if requires, err := d.run.run("dnf", "-q", "repoquery", "--requires", "--resolve", "--qf", "%{name}", pkg); err == nil {
+		for _, name := range lines(requires) {
+			if name != info.Name && !slices.Contains(info.Dependencies, name) {
+				info.Dependencies = append(info.Dependencies, name)
+			}
+		}
+	}
+
+	info.ReverseDependencies = []string{}
+	if rdepends, err := d.run.run("dnf", "-q", "repoquery", "--installed", "--whatrequires", pkg, "--qf", "%{name}"); err == nil {
+		info.ReverseDependencies = append(info.ReverseDependencies, lines(rdepends)...)
+	}
+	return info, nil
+}
+
+func joinVersion(version, release string) string {
+	if release == "" {
+		return version
+	}
+	return version + "-" + release
+}
+
+// rpmVersions maps installed package names to their version-release,
+// which is the format dnf reports candidates in.
+func rpmVersions(run Runner) map[string]string {
+	versions := map[string]string{}
+	out, err := run.run("rpm", "-qa", "--qf", "%{NAME}\t%{VERSION}-%{RELEASE}\n")
+	if err != nil {
+		return versions
+	}
+	for _, line := range lines(out) {
+		name, version, _ := strings.Cut(line, "\t")
+		versions[name] = version
+	}
+	return versions
+}
+
+// listRPM lists installed packages from the rpm database. It is shared by
+// every RPM-based backend.
+func listRPM(run Runner) ([]InstalledPackage, error) {
+	out, err := run.run("rpm", "-qa", "--qf", "%{NAME}\t%{VERSION}\n")
+	if err != nil {
+		return nil, err
+	}
+
+	packages := []InstalledPackage{}
+	for _, line := range lines(out) {
+		name, version, _ := strings.Cut(line, "\t")
+		packages = append(packages, InstalledPackage{Name: name, Version: version})
+	}
+	return packages, nil
+}
+
+var dnfReposDir = "/etc/yum.repos.d"
+
+// ListRepositories reads the sections of every .repo file. A file may
+// define several repositories, e.g. fedora.repo has fedora and its
+// debuginfo and source variants.
+func (d *dnf) ListRepositories() ([]Repository, error) {
+	files, err := filepath.Glob(filepath.Join(dnfReposDir, "*.repo"))
+	if err != nil {
+		return nil, err
+	}
+
+	repos := []Repository{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		fileLines := strings.Split(string(data), "\n")
+		for _, s := range parseSections(fileLines) {
+			if s.Commented {
+				continue
+			}
+			repo := Repository{
+				ID:      s.Name,
+				Name:    sectionValue(fileLines, s, "name"),
+				URLs:    []string{},
+				Enabled: sectionValue(fileLines, s, "enabled") != "0",
+				File:    file,
+			}
+			for _, key := range []string{"baseurl", "metalink", "mirrorlist"} {
+				for _, value := range sectionValues(fileLines, s, key) {
+					repo.URLs = append(repo.URLs, strings.Fields(value)...)
+				}
+			}
+			repos = append(repos, repo)
+		}
+	}
+	return repos, nil
+}
+
+// AddRepository writes a .repo file for a base URL, or installs a vendor's
+// own .repo file when the URL points at one (as Docker and Grafana publish).
+// A base URL needs a key URL, or spec.Insecure to turn off gpgcheck, and a
+// vendor file must check signatures against https keys unless spec.Insecure.
+func (d *dnf) AddRepository(spec RepositorySpec) (*Repository, error) {
+	if spec.URL == "" {
+		return nil, errors.New("url is required")
+	}
+
+	var content []byte
+	if strings.HasSuffix(spec.URL, ".repo") {
+		if spec.ID == "" {
+			spec.ID = strings.TrimSuffix(path.Base(spec.URL), ".repo")
+		}
+		data, err := fetch(spec.URL)
+		if err != nil {
+			return nil, err
+		}
+		fileLines := strings.Split(string(data), "\n")
+		sections := parseSections(fileLines)
+		if len(sections) == 0 {
+			return nil, fmt.Errorf("%s is not a .repo file", spec.URL)
+		}
+		if !spec.Insecure {
+			if err := checkRepoFile(fileLines, sections); err != nil {
+				return nil, fmt.Errorf("%s: %w", spec.URL, err)
+			}
+		}
+		content = data
+	} else {
+		name := spec.Name
+		if name == "" {
+			name = spec.ID
+		}
+		if strings.ContainsAny(name, "\r\n") {
+			return nil, fmt.Errorf("invalid repository name %q", name)
+		}
+		if err := checkSigningKey(spec, true); err != nil {
+			return nil, err
+		}
+		gpgcheck := "0"
+		if spec.KeyURL != "" {
+			gpgcheck = "1"
+		}
+		content = []byte(fmt.Sprintf("[%s]\nname=%s\nbaseurl=%s\nenabled=1\ngpgcheck=%s\n", spec.ID, name, spec.URL, gpgcheck))
+		if spec.KeyURL != "" {
+			// dnf imports the key from here on the first install
+			content = append(content, "gpgkey="+spec.KeyURL+"\n"...)
+		}
+	}
+	if err := validateRepository(spec.ID, spec.URL, spec.KeyURL); err != nil {
+		return nil, err
+	}
+
+	file := filepath.Join(dnfReposDir, spec.ID+".repo")
+	if _, err := os.Stat(file); err == nil {
+		return nil, fmt.Errorf("repository %s already exists", spec.ID)
+	}
+	if err := utils.InstallFile(d.run, file, content); err != nil {
+		return nil, err
+	}
+	return &Repository{ID: spec.ID, Name: spec.Name, URLs: []string{spec.URL}, Enabled: true, File: file}, nil
+}
+
+// checkRepoFile requires every repository in a vendor .repo file to check
+// package signatures with keys fetched over https. Otherwise the file could
+// have root install whatever its mirrors serve.
+func checkRepoFile(fileLines []string, sections []confSection) error {
+	for _, s := range sections {
+		if s.Commented {
+			continue
+		}
+		// Every value is checked, since a later duplicate overrides the first
+		gpgcheck := sectionValues(fileLines, s, "gpgcheck")
+		if len(gpgcheck) == 0 || slices.ContainsFunc(gpgcheck, func(v string) bool { return v != "1" }) {
+			return fmt.Errorf("repository %s does not set gpgcheck=1; set insecure to add it anyway", s.Name)
+		}
+		keys := repoFileValues(fileLines, s, "gpgkey")
+		if len(keys) == 0 {
+			return fmt.Errorf("repository %s has no gpgkey; set insecure to add it anyway", s.Name)
+		}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, "https://") {
+				return fmt.Errorf("repository %s has gpgkey %s, which is not an https URL", s.Name, key)
+			}
+		}
+	}
+	return nil
+}
+
+// repoFileValues splits the values of a key in a .repo section. dnf reads
+// indented lines after a key as more of its value, which is how vendors
+// list several keys.
+func repoFileValues(fileLines []string, s confSection, key string) []string {
+	var values []string
+	inKey := false
+	for _, line := range fileLines[s.Start+1 : s.End] {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			inKey = false
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if inKey {
+				values = append(values, splitList(trimmed)...)
+			}
+			continue
+		}
+		k, v, _ := strings.Cut(trimmed, "=")
+		inKey = strings.TrimSpace(k) == key
+		if inKey {
+			values = append(values, splitList(v)...)
+		}
+	}
+	return values
+}
+
+// splitList splits a .repo list value, which dnf separates by commas or
+// whitespace.
+func splitList(value string) []string {
+	return strings.Fields(strings.ReplaceAll(value, ",", " "))
+}
+
+// repoSection finds the file and section defining a repository id.
+func (d *dnf) repoSection(id string) (string, []string, confSection, error) {
+	files, err := filepath.Glob(filepath.Join(dnfReposDir, "*.repo"))
+	if err != nil {
+		return "", nil, confSection{}, err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", nil, confSection{}, err
+		}
+		fileLines := strings.Split(string(data), "\n")
+		if s, found := findSection(parseSections(fileLines), id); found && !s.Commented {
+			return file, fileLines, s, nil
+		}
+	}
+	return "", nil, confSection{}, ErrRepositoryNotFound
+}
+
+// SetRepositoryEnabled edits the .repo file directly rather than using
+// config-manager, whose syntax differs between dnf 4 and dnf 5.
+func (d *dnf) SetRepositoryEnabled(id string, enabled bool) error {
+	file, fileLines, s, err := d.repoSection(id)
+	if err != nil {
+		return err
+	}
+	value := "0"
+	if enabled {
+		value = "1"
+	}
+	fileLines = setSectionValue(fileLines, s, "enabled", value)
+	return utils.InstallFile(d.run, file, []byte(strings.Join(fileLines, "\n")))
+}
+
+// RemoveRepository deletes the repository's section, and the whole file once
+// no repositories are left in it.
+func (d *dnf) RemoveRepository(id string) error {
+	file, fileLines, s, err := d.repoSection(id)
+	if err != nil {
+		return err
+	}
+	fileLines = removeSection(fileLines, s)
+	if len(parseSections(fileLines)) == 0 {
+		return removeFile(d.run, file)
+	}
+	return utils.InstallFile(d.run, file, []byte(strings.Join(fileLines, "\n")))
+}
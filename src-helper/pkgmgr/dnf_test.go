@@ -0,0 +1,95 @@
+package pkgmgr
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDnfAddRepositoryChecksVendorFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		insecure bool
+		wantErr  string
+	}{
+		{
+			name: "signed",
+			file: "[vendor]\nname=Vendor\nbaseurl=https://example.com/rpm\ngpgcheck=1\ngpgkey=https://example.com/key.asc\n",
+		},
+		{
+			name:    "gpgcheck off",
+			file:    "[vendor]\nname=Vendor\nbaseurl=https://example.com/rpm\ngpgcheck=0\ngpgkey=https://example.com/key.asc\n",
+			wantErr: "does not set gpgcheck=1",
+		},
+		{
+			name:     "gpgcheck off and insecure",
+			file:     "[vendor]\nname=Vendor\nbaseurl=https://example.com/rpm\ngpgcheck=0\n",
+			insecure: true,
+		},
+		{
+			name:    "gpgcheck missing",
+			file:    "[vendor]\nname=Vendor\nbaseurl=https://example.com/rpm\ngpgkey=https://example.com/key.asc\n",
+			wantErr: "does not set gpgcheck=1",
+		},
+		{
+			name:    "gpgcheck overridden",
+			file:    "[vendor]\nname=Vendor\ngpgcheck=1\ngpgkey=https://example.com/key.asc\ngpgcheck=0\n",
+			wantErr: "does not set gpgcheck=1",
+		},
+		{
+			name:    "second section unsigned",
+			file:    "[vendor]\ngpgcheck=1\ngpgkey=https://example.com/key.asc\n\n[vendor-source]\ngpgcheck=0\n",
+			wantErr: "repository vendor-source",
+		},
+		{
+			name:    "no key",
+			file:    "[vendor]\nname=Vendor\ngpgcheck=1\n",
+			wantErr: "has no gpgkey",
+		},
+		{
+			name:    "http key",
+			file:    "[vendor]\nname=Vendor\ngpgcheck=1\ngpgkey=http://example.com/key.asc\n",
+			wantErr: "not an https URL",
+		},
+		{
+			name:    "http key on a continuation line",
+			file:    "[vendor]\nname=Vendor\ngpgcheck=1\ngpgkey=https://example.com/key.asc\n       http://example.com/old.asc\n",
+			wantErr: "not an https URL",
+		},
+	}
+
+	reposDir, fetchFile := dnfReposDir, fetch
+	t.Cleanup(func() { dnfReposDir, fetch = reposDir, fetchFile })
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dnfReposDir = t.TempDir()
+			fetch = func(url string) ([]byte, error) {
+				return []byte(tt.file), nil
+			}
+			installed := false
+			run := Runner(func(name string, args ...string) (string, string, error) {
+				installed = name == "sudo" && len(args) > 0 && args[0] == "install"
+				return "", "", nil
+			})
+
+			d := &dnf{run: run}
+			_, err := d.AddRepository(RepositorySpec{URL: "https://example.com/vendor.repo", Insecure: tt.insecure})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("AddRepository() error = %v", err)
+				}
+				if !installed {
+					t.Fatal("AddRepository() did not install the file")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("AddRepository() error = %v, want %q", err, tt.wantErr)
+			}
+			if installed {
+				t.Fatal("AddRepository() installed a rejected file")
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package pkgmgr
+
+import (
+	"strings"
+)
+
+// flatpak installs applications system-wide from the configured remotes
+// (usually Flathub).
+type flatpak struct {
+	run Runner
+}
+
+func init() {
+	registerSource("flatpak", "flatpak", func(run Runner) AppSource { return &flatpak{run: run} })
+}
+
+func (f *flatpak) Name() string {
+	return "flatpak"
+}
+
+func (f *flatpak) Install(pkg string) (string, error) {
+	return f.run.run("sudo", "flatpak", "install", "--system", "-y", "--noninteractive", pkg)
+}
+
+func (f *flatpak) Remove(pkg string) (string, error) {
+	return f.run.run("sudo", "flatpak", "uninstall", "--system", "-y", "--noninteractive", pkg)
+}
+
+func (f *flatpak) Search(query string) ([]SearchResult, error) {
+	out, err := f.run.run("flatpak", "search", "--columns=application,description", query)
+	if err != nil {
+		return nil, err
+	}
+
+	// Columns are tab-separated; no matches prints "No matches found"
+	results := []SearchResult{}
+	for _, line := range lines(out) {
+		id, desc, found := strings.Cut(line, "\t")
+		if !found {
+			continue
+		}
+		results = append(results, SearchResult{Name: id, Description: strings.TrimSpace(desc)})
+	}
+	return results, nil
+}
+
+func (f *flatpak) ListInstalled() ([]InstalledPackage, error) {
+	out, err := f.run.run("flatpak", "list", "--app", "--columns=application,version")
+	if err != nil {
+		return nil, err
+	}
+
+	packages := []InstalledPackage{}
+	for _, line := range lines(out) {
+		id, version, _ := strings.Cut(line, "\t")
+		packages = append(packages, InstalledPackage{Name: id, Version: strings.TrimSpace(version)})
+	}
+	return packages, nil
+}
@@ -0,0 +1,334 @@
+package pkgmgr
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"piControlHelper/utils"
+)
+
+// ErrUnsupported is returned when no backend is registered for a distribution.
+var ErrUnsupported = errors.New("unsupported distribution")
+
+// ErrNotFound is returned when a package does not exist in any repository.
+var ErrNotFound = errors.New("package not found")
+
+// PackageManager is implemented once per distribution family. Handlers only
+// talk to this interface, so adding a distro means adding a backend file.
+type PackageManager interface {
+	// Name returns the name of the underlying tool (apt, dnf, pacman, ...).
+	Name() string
+	// Refresh brings the local package lists up to date where the tool needs it.
+	Refresh() error
+	Install(pkg string) (string, error)
+	// Versioned returns the Install argument that selects a specific version
+	// of pkg, e.g. "nginx=1.22.1-9" for apt.
+	Versioned(pkg, version string) string
+	// InstallFile installs a local package file such as a .deb or .rpm.
+	InstallFile(path string) (string, error)
+	Remove(pkg string) (string, error)
+	// SimulateInstall and SimulateRemove run the tool's simulate mode and
+	// report what the real operation would change, without changing anything.
+	SimulateInstall(pkgs ...string) (*Transaction, error)
+	SimulateRemove(pkgs ...string) (*Transaction, error)
+	Search(query string) ([]SearchResult, error)
+	// ListAvailable lists every package in the local package lists, for
+	// building a search index.
+	ListAvailable() ([]SearchResult, error)
+	ListInstalled() ([]InstalledPackage, error)
+	// ListUpdates lists installed packages with a newer candidate version.
+	ListUpdates() ([]Update, error)
+	// Upgrade upgrades the given packages, or the whole system when none are given.
+	Upgrade(pkgs ...string) (string, error)
+	Info(pkg string) (*PackageInfo, error)
+}
+
+// Holder is implemented by backends that can hold packages at their
+// installed version, so upgrades leave them alone until they are unheld.
+type Holder interface {
+	Hold(pkg string) (string, error)
+	Unhold(pkg string) (string, error)
+	ListHeld() ([]string, error)
+}
+
+// ErrHoldUnsupported is returned by a Holder when the system lacks what its
+// holds need, e.g. dnf 4 without the versionlock plugin.
+var ErrHoldUnsupported = errors.New("package holds are not supported on this system")
+
+// holdChecker is implemented by holders whose support depends on what is
+// installed.
+type holdChecker interface {
+	checkHolds() error
+}
+
+// CheckHolds returns an ErrHoldUnsupported error when h can't hold packages
+// on this system.
+func CheckHolds(h Holder) error {
+	if checker, ok := h.(holdChecker); ok {
+		return checker.checkHolds()
+	}
+	return nil
+}
+
+// SearchResult and InstalledPackage carry a Source, which the handlers set to
+// "native" for the distribution's package manager or to an AppSource name.
+type SearchResult struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Source      string `json:"source"`
+}
+
+type InstalledPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Source  string `json:"source"`
+	// Held is filled in by callers that know about holds, see Holder.
+	Held bool `json:"held"`
+}
+
+type Update struct {
+	Name             string `json:"name"`
+	CurrentVersion   string `json:"current_version"`
+	CandidateVersion string `json:"candidate_version"`
+}
+
+// Transaction is the outcome of a simulated install or removal. DiskSize is
+// positive when space would be used and negative when it would be freed.
+// Sizes are in bytes and zero when the tool doesn't report them.
+type Transaction struct {
+	Install      []TransactionPackage `json:"install"`
+	Upgrade      []TransactionPackage `json:"upgrade"`
+	Remove       []TransactionPackage `json:"remove"`
+	DownloadSize int64                `json:"download_size"`
+	DiskSize     int64                `json:"disk_size"`
+}
+
+type TransactionPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+func newTransaction() *Transaction {
+	return &Transaction{
+		Install: []TransactionPackage{},
+		Upgrade: []TransactionPackage{},
+		Remove:  []TransactionPackage{},
+	}
+}
+
+// PackageInfo describes a package as the repositories and the local
+// database see it. Sizes are in bytes and zero when the tool doesn't report them.
+type PackageInfo struct {
+	Name                string   `json:"name"`
+	Version             string   `json:"version"`
+	InstalledVersion    string   `json:"installed_version,omitempty"`
+	Description         string   `json:"description"`
+	Repository          string   `json:"repository"`
+	DownloadSize        int64    `json:"download_size"`
+	InstalledSize       int64    `json:"installed_size"`
+	Installed           bool     `json:"installed"`
+	Dependencies        []string `json:"dependencies"`
+	ReverseDependencies []string `json:"reverse_dependencies"`
+}
+
+// Runner executes a command and returns its stdout and stderr.
+// utils.RunCommand is the default; streaming callers can swap it.
+type Runner func(name string, args ...string) (string, string, error)
+
+// CommandError is returned when a package manager command exits with an error.
+// Its message is the command's stderr so handlers can pass it straight through.
+type CommandError struct {
+	Err    error
+	Stderr string
+}
+
+func (e *CommandError) Error() string {
+	if e.Stderr != "" {
+		return e.Stderr
+	}
+	return e.Err.Error()
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+func (r Runner) run(name string, args ...string) (string, error) {
+	out, errout, err := r(name, args...)
+	if err != nil {
+		return out, &CommandError{Err: err, Stderr: errout}
+	}
+	return out, nil
+}
+
+// exitCode returns the exit status of a failed command, or -1 if it did not run.
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// installedVersions maps package names to installed versions.
+func installedVersions(pm PackageManager) map[string]string {
+	versions := map[string]string{}
+	installed, _ := pm.ListInstalled()
+	for _, pkg := range installed {
+		versions[pkg.Name] = pkg.Version
+	}
+	return versions
+}
+
+// succeeds reports whether the command exits cleanly, ignoring its output.
+func (r Runner) succeeds(name string, args ...string) bool {
+	_, _, err := r(name, args...)
+	return err == nil
+}
+
+var backends = map[string]func(Runner) PackageManager{}
+
+// register makes a backend available for the distro string returned by
+// utils.IdentifyDistro. Backends call it from init.
+func register(distro string, factory func(Runner) PackageManager) {
+	backends[distro] = factory
+}
+
+// New returns the backend for distro using utils.RunCommand.
+func New(distro string) (PackageManager, error) {
+	return NewWithRunner(distro, utils.RunCommand)
+}
+
+// NewWithRunner returns the backend for distro using a custom command runner.
+func NewWithRunner(distro string, run Runner) (PackageManager, error) {
+	factory, ok := backends[distro]
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return factory(run), nil
+}
+
+// parseFields reads "Key: value" style output such as apt-cache show or
+// dnf info. Only the first occurrence of each key is kept and indented
+// continuation lines are ignored.
+func parseFields(out string) map[string]string {
+	fields := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		if _, exists := fields[key]; !exists {
+			fields[key] = strings.TrimSpace(value)
+		}
+	}
+	return fields
+}
+
+// splitPkgver splits "name-version" strings where the version is the last
+// n dash-separated segments (e.g. apk's name-1.2.3-r0 uses n=2).
+func splitPkgver(pkgver string, n int) (string, string) {
+	parts := strings.Split(pkgver, "-")
+	if len(parts) <= n {
+		return pkgver, ""
+	}
+	return strings.Join(parts[:len(parts)-n], "-"), strings.Join(parts[len(parts)-n:], "-")
+}
+
+// parseSize converts sizes like "1.5 MiB", "230 k" or "4096" to bytes.
+// A bare number is multiplied by unit.
+func parseSize(s string, unit int64) int64 {
+	s = strings.TrimSpace(s)
+	i := 0
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.' || s[i] == ',') {
+		i++
+	}
+	value, err := strconv.ParseFloat(strings.ReplaceAll(s[:i], ",", ""), 64)
+	if err != nil {
+		return 0
+	}
+
+	suffix := strings.ToUpper(strings.TrimSpace(s[i:]))
+	switch {
+	case suffix == "":
+	case strings.HasPrefix(suffix, "K"):
+		unit = 1 << 10
+	case strings.HasPrefix(suffix, "M"):
+		unit = 1 << 20
+	case strings.HasPrefix(suffix, "G"):
+		unit = 1 << 30
+	default:
+		unit = 1
+	}
+	return int64(value * float64(unit))
+}
+
+// depName strips version constraints from a dependency such as
+// "libc6 (>= 2.34)" or "glibc>=2.38", keeping alternatives like "a | b".
+func depName(dep string) string {
+	alternatives := strings.Split(dep, "|")
+	for i, alt := range alternatives {
+		alt = strings.TrimSpace(alt)
+		if cut := strings.IndexAny(alt, " (<>="); cut > 0 {
+			alt = alt[:cut]
+		}
+		alternatives[i] = alt
+	}
+	return strings.Join(alternatives, " | ")
+}
+
+// depList splits a separated dependency list, dropping versions and "None".
+func depList(list, sep string) []string {
+	deps := []string{}
+	for _, dep := range strings.Split(list, sep) {
+		dep = strings.TrimSpace(dep)
+		if dep == "" || dep == "None" {
+			continue
+		}
+		deps = append(deps, depName(dep))
+	}
+	return deps
+}
+
+// checkPackageFile rejects files the backend's tool can't install, so an
+// uploaded .rpm isn't handed to dpkg.
+func checkPackageFile(tool, path string, exts ...string) error {
+	for _, ext := range exts {
+		if strings.HasSuffix(path, ext) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s can only install %s files", tool, strings.Join(exts, ", "))
+}
+
+// between returns the text after open up to the next close, or "".
+func between(s, open, close string) string {
+	_, after, found := strings.Cut(s, open)
+	if !found {
+		return ""
+	}
+	value, _, _ := strings.Cut(after, close)
+	return value
+}
+
+// lines returns the non-empty lines of out.
+func lines(out string) []string {
+	var result []string
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.TrimSpace(line) != "" {
+			result = append(result, line)
+		}
+	}
+	return result
+}
@@ -0,0 +1,447 @@
+package pkgmgr
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"piControlHelper/utils"
+)
+
+// pacman backs Arch Linux and its derivatives.
+type pacman struct {
+	run Runner
+}
+
+func init() {
+	register("arch", func(run Runner) PackageManager { return &pacman{run: run} })
+}
+
+func (p *pacman) Name() string {
+	return "pacman"
+}
+
+// Refresh is a no-op: syncing the databases without upgrading (pacman -Sy)
+// leads to partial upgrades, which Arch does not support.
+func (p *pacman) Refresh() error {
+	return nil
+}
+
+func (p *pacman) Install(pkg string) (string, error) {
+	return p.run.run("sudo", "pacman", "-S", "--noconfirm", pkg)
+}
+
+// Versioned uses pacman's dependency syntax. The sync repositories only
+// carry the latest build, so older versions fail unless they are cached.
+func (p *pacman) Versioned(pkg, version string) string {
+	return pkg + "=" + version
+}
+
+func (p *pacman) InstallFile(path string) (string, error) {
+	if err := checkPackageFile(p.Name(), path, ".pkg.tar.zst", ".pkg.tar.xz", ".pkg.tar.gz"); err != nil {
+		return "", err
+	}
+	return p.run.run("sudo", "pacman", "-U", "--noconfirm", path)
+}
+
+func (p *pacman) Remove(pkg string) (string, error) {
+	return p.run.run("sudo", "pacman", "-R", "--noconfirm", pkg)
+}
+
+func (p *pacman) SimulateInstall(pkgs ...string) (*Transaction, error) {
+	// --print lists the targets (including dependencies) without installing
+	args := append([]string{"-S", "--print", "--print-format", "%n %v %s"}, pkgs...)
+	out, err := p.run.run("pacman", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := newTransaction()
+	for _, line := range lines(out) {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		pkg := TransactionPackage{Name: fields[0], Version: fields[1]}
+		if p.run.succeeds("pacman", "-Q", pkg.Name) {
+			tx.Upgrade = append(tx.Upgrade, pkg)
+		} else {
+			tx.Install = append(tx.Install, pkg)
+		}
+		tx.DownloadSize += parseSize(fields[2], 1)
+	}
+	return tx, nil
+}
+
+func (p *pacman) SimulateRemove(pkgs ...string) (*Transaction, error) {
+	args := append([]string{"-R", "--print", "--print-format", "%n %v"}, pkgs...)
+	out, err := p.run.run("pacman", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := newTransaction()
+	for _, line := range lines(out) {
+		name, version, _ := strings.Cut(line, " ")
+		tx.Remove = append(tx.Remove, TransactionPackage{Name: name, Version: version})
+		if local, err := p.run.run("pacman", "-Qi", name); err == nil {
+			tx.DiskSize -= parseSize(parseFields(local)["Installed Size"], 1)
+		}
+	}
+	return tx, nil
+}
+
+func (p *pacman) Search(query string) ([]SearchResult, error) {
+	out, err := p.run.run("pacman", "-Ss", query)
+	if err != nil {
+		return nil, err
+	}
+
+	// pacman -Ss prints "repo/name version [installed]" followed by an
+	// indented description line.
+	results := []SearchResult{}
+	for _, line := range lines(out) {
+		if strings.HasPrefix(line, " ") {
+			if len(results) > 0 {
+				results[len(results)-1].Description = strings.TrimSpace(line)
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		_, name, found := strings.Cut(fields[0], "/")
+		if !found {
+			continue
+		}
+		results = append(results, SearchResult{Name: name})
+	}
+	return results, nil
+}
+
+// ListAvailable searches for "." since pacman -Ss takes a regex.
+func (p *pacman) ListAvailable() ([]SearchResult, error) {
+	return p.Search(".")
+}
+
+func (p *pacman) ListInstalled() ([]InstalledPackage, error) {
+	out, err := p.run.run("pacman", "-Q")
+	if err != nil {
+		return nil, err
+	}
+
+	packages := []InstalledPackage{}
+	for _, line := range lines(out) {
+		name, version, _ := strings.Cut(line, " ")
+		packages = append(packages, InstalledPackage{Name: name, Version: version})
+	}
+	return packages, nil
+}
+
+func (p *pacman) ListUpdates() ([]Update, error) {
+	// checkupdates (pacman-contrib) syncs into a temporary database, so it
+	// sees new versions without a partial upgrade. Fall back to the local
+	// sync database when it isn't installed.
+	out, err := p.run.run("checkupdates")
+	if err != nil && exitCode(err) == -1 {
+		out, err = p.run.run("pacman", "-Qu")
+	}
+	// Both exit non-zero when there is nothing to upgrade
+	if err != nil && strings.TrimSpace(out) != "" {
+		return nil, err
+	}
+
+	// Lines look like "name 1.0-1 -> 1.1-1"
+	updates := []Update{}
+	for _, line := range lines(out) {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[2] != "->" {
+			continue
+		}
+		updates = append(updates, Update{Name: fields[0], CurrentVersion: fields[1], CandidateVersion: fields[3]})
+	}
+	return updates, nil
+}
+
+func (p *pacman) Upgrade(pkgs ...string) (string, error) {
+	if len(pkgs) == 0 {
+		return p.run.run("sudo", "pacman", "-Syu", "--noconfirm")
+	}
+	args := append([]string{"pacman", "-S", "--needed", "--noconfirm"}, pkgs...)
+	return p.run.run("sudo", args...)
+}
+
+// Hold adds the package to IgnorePkg in pacman.conf, which -Syu then skips.
+func (p *pacman) Hold(pkg string) (string, error) {
+	held, err := p.ListHeld()
+	if err != nil {
+		return "", err
+	}
+	if slices.Contains(held, pkg) {
+		return pkg + " is already held", nil
+	}
+	if pkg == "" || strings.ContainsAny(pkg, " \t\r\n#=") {
+		return "", fmt.Errorf("invalid package name %q", pkg)
+	}
+	return "held " + pkg, p.setIgnored(append(held, pkg))
+}
+
+func (p *pacman) Unhold(pkg string) (string, error) {
+	held, err := p.ListHeld()
+	if err != nil {
+		return "", err
+	}
+	if !slices.Contains(held, pkg) {
+		return pkg + " was not held", nil
+	}
+	return "unheld " + pkg, p.setIgnored(slices.DeleteFunc(held, func(name string) bool { return name == pkg }))
+}
+
+func (p *pacman) ListHeld() ([]string, error) {
+	fileLines, err := p.readConf()
+	if err != nil {
+		return nil, err
+	}
+	held := []string{}
+	if options, found := findSection(parseSections(fileLines), "options"); found {
+		for _, value := range sectionValues(fileLines, options, "IgnorePkg") {
+			held = append(held, strings.Fields(value)...)
+		}
+	}
+	return held, nil
+}
+
+// setIgnored rewrites IgnorePkg as a single line in place of the first
+// existing one, or of the stock commented-out "#IgnorePkg   =".
+func (p *pacman) setIgnored(held []string) error {
+	fileLines, err := p.readConf()
+	if err != nil {
+		return err
+	}
+	options, found := findSection(parseSections(fileLines), "options")
+	if !found {
+		return errors.New("no [options] section in " + pacmanConf)
+	}
+
+	line := "IgnorePkg = " + strings.Join(held, " ")
+	if len(held) == 0 {
+		line = "#IgnorePkg   ="
+	}
+	var updated []string
+	placed := false
+	for i, current := range fileLines {
+		key, _, isKey := strings.Cut(strings.TrimLeft(current, "# "), "=")
+		if i <= options.Start || i >= options.End || !isKey || strings.TrimSpace(key) != "IgnorePkg" {
+			updated = append(updated, current)
+			continue
+		}
+		if !placed {
+			updated = append(updated, line)
+			placed = true
+		}
+	}
+	if !placed {
+		updated = slices.Insert(updated, options.Start+1, line)
+	}
+	return p.writeConf(updated)
+}
+
+func (p *pacman) Info(pkg string) (*PackageInfo, error) {
+	local, localErr := p.run.run("pacman", "-Qi", pkg)
+	installed := localErr == nil
+
+	out, err := p.run.run("pacman", "-Si", pkg)
+	if err != nil && installed {
+		// Locally built or foreign packages only exist in the local database
+		out, err = local, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fields := parseFields(out)
+	info := &PackageInfo{
+		Name:                fields["Name"],
+		Version:             fields["Version"],
+		Description:         fields["Description"],
+		Repository:          fields["Repository"],
+		DownloadSize:        parseSize(fields["Download Size"], 1),
+		InstalledSize:       parseSize(fields["Installed Size"], 1),
+		Installed:           installed,
+		Dependencies:        depList(fields["Depends On"], " "),
+		ReverseDependencies: depList(fields["Required By"], " "),
+	}
+	if installed {
+		// The local database knows which installed packages require this one
+		localFields := parseFields(local)
+		info.InstalledVersion = localFields["Version"]
+		info.ReverseDependencies = depList(localFields["Required By"], " ")
+	}
+	return info, nil
+}
+
+var pacmanConf = "/etc/pacman.conf"
+
+func (p *pacman) readConf() ([]string, error) {
+	data, err := os.ReadFile(pacmanConf)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(data), "\n"), nil
+}
+
+func (p *pacman) writeConf(fileLines []string) error {
+	return utils.InstallFile(p.run, pacmanConf, []byte(strings.Join(fileLines, "\n")))
+}
+
+// ListRepositories lists the repository sections of pacman.conf. Sections
+// commented out as a whole, like the stock "#[multilib]", are disabled.
+func (p *pacman) ListRepositories() ([]Repository, error) {
+	fileLines, err := p.readConf()
+	if err != nil {
+		return nil, err
+	}
+
+	repos := []Repository{}
+	for _, s := range parseSections(fileLines) {
+		if s.Name == "options" {
+			continue
+		}
+		urls := sectionValues(fileLines, s, "Server")
+		if urls == nil {
+			urls = []string{}
+		}
+		repos = append(repos, Repository{ID: s.Name, URLs: urls, Enabled: !s.Commented, File: pacmanConf})
+	}
+	return repos, nil
+}
+
+// AddRepository appends a section to pacman.conf. With a key URL the key is
+// added to pacman's keyring and locally signed so packages are verified;
+// without one, which needs spec.Insecure, the repository is trusted as is.
+// New repositories are synced
+// by the next full upgrade, since a bare pacman -Sy would be a partial upgrade.
+func (p *pacman) AddRepository(spec RepositorySpec) (*Repository, error) {
+	if spec.URL == "" {
+		return nil, errors.New("url is required")
+	}
+	if err := validateRepository(spec.ID, spec.URL, spec.KeyURL); err != nil {
+		return nil, err
+	}
+	if spec.ID == "options" {
+		return nil, fmt.Errorf("invalid repository id %q", spec.ID)
+	}
+	if err := checkSigningKey(spec, true); err != nil {
+		return nil, err
+	}
+
+	fileLines, err := p.readConf()
+	if err != nil {
+		return nil, err
+	}
+	if _, found := findSection(parseSections(fileLines), spec.ID); found {
+		return nil, fmt.Errorf("repository %s already exists", spec.ID)
+	}
+
+	sigLevel := "Optional TrustAll"
+	if spec.KeyURL != "" {
+		if err := p.trustKey(spec.KeyURL); err != nil {
+			return nil, err
+		}
+		sigLevel = "Required DatabaseOptional"
+	}
+
+	for len(fileLines) > 0 && strings.TrimSpace(fileLines[len(fileLines)-1]) == "" {
+		fileLines = fileLines[:len(fileLines)-1]
+	}
+	fileLines = append(fileLines, "", "["+spec.ID+"]", "SigLevel = "+sigLevel, "Server = "+spec.URL, "")
+	if err := p.writeConf(fileLines); err != nil {
+		return nil, err
+	}
+	return &Repository{ID: spec.ID, URLs: []string{spec.URL}, Enabled: true, File: pacmanConf}, nil
+}
+
+// trustKey imports a signing key into pacman's keyring and locally signs it,
+// which is what vendor instructions do with pacman-key by hand.
+func (p *pacman) trustKey(url string) error {
+	key, err := fetch(url)
+	if err != nil {
+		return err
+	}
+	tmp, err := utils.WriteTemp(key)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	// "fpr" records hold the fingerprint in the tenth field
+	out, err := p.run.run("gpg", "--show-keys", "--with-colons", tmp)
+	if err != nil {
+		return err
+	}
+	var fingerprints []string
+	for _, line := range lines(out) {
+		fields := strings.Split(line, ":")
+		if fields[0] == "fpr" && len(fields) > 9 {
+			fingerprints = append(fingerprints, fields[9])
+		}
+	}
+	if len(fingerprints) == 0 {
+		return fmt.Errorf("no key found at %s", url)
+	}
+
+	if _, err := p.run.run("sudo", "pacman-key", "--add", tmp); err != nil {
+		return err
+	}
+	// Only the primary key needs signing; subkey fingerprints follow it
+	_, err = p.run.run("sudo", "pacman-key", "--lsign-key", fingerprints[0])
+	return err
+}
+
+// pacmanSystemRepos hold the base system and its updates. Without them
+// pacman -Syu can't update the system, and a partial upgrade breaks it.
+var pacmanSystemRepos = []string{"core", "extra"}
+
+func (p *pacman) SetRepositoryEnabled(id string, enabled bool) error {
+	fileLines, err := p.readConf()
+	if err != nil {
+		return err
+	}
+	s, found := findSection(parseSections(fileLines), id)
+	if !found || id == "options" {
+		return ErrRepositoryNotFound
+	}
+	if !enabled && slices.Contains(pacmanSystemRepos, id) {
+		return ErrRepositoryRequired
+	}
+	if s.Commented == !enabled {
+		return nil
+	}
+
+	for i := s.Start; i < s.End; i++ {
+		trimmed := strings.TrimSpace(fileLines[i])
+		switch {
+		case trimmed == "":
+		case enabled:
+			fileLines[i] = strings.TrimSpace(strings.TrimPrefix(trimmed, "#"))
+		case !strings.HasPrefix(trimmed, "#"):
+			fileLines[i] = "#" + fileLines[i]
+		}
+	}
+	return p.writeConf(fileLines)
+}
+
+func (p *pacman) RemoveRepository(id string) error {
+	fileLines, err := p.readConf()
+	if err != nil {
+		return err
+	}
+	s, found := findSection(parseSections(fileLines), id)
+	if !found || id == "options" {
+		return ErrRepositoryNotFound
+	}
+	if slices.Contains(pacmanSystemRepos, id) {
+		return ErrRepositoryRequired
+	}
+	return p.writeConf(removeSection(fileLines, s))
+}
@@ -0,0 +1,225 @@
+package pkgmgr
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ErrRepositoryNotFound is returned when no configured repository has the given id.
+var ErrRepositoryNotFound = errors.New("repository not found")
+
+// ErrRepositoryRequired is returned when disabling or removing a repository
+// the system can't be updated without.
+var ErrRepositoryRequired = errors.New("repository is required by the system and can't be disabled or removed")
+
+// RepositoryManager is implemented by backends that can manage their package
+// sources. Handlers check for it with a type assertion, so distros without
+// support simply don't implement it.
+type RepositoryManager interface {
+	ListRepositories() ([]Repository, error)
+	AddRepository(spec RepositorySpec) (*Repository, error)
+	// SetRepositoryEnabled enables or disables a repository without removing it.
+	SetRepositoryEnabled(id string, enabled bool) error
+	// RemoveRepository removes the repository and any signing key added with it.
+	RemoveRepository(id string) error
+}
+
+type Repository struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name,omitempty"`
+	URLs    []string `json:"urls"`
+	Enabled bool     `json:"enabled"`
+	File    string   `json:"file"`
+}
+
+// RepositorySpec describes a repository to add. Suite and Components only
+// apply to apt. URL may also be "ppa:owner/name" on Ubuntu, or a link to a
+// vendor .repo file on dnf, in which case ID defaults from it.
+type RepositorySpec struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	URL        string   `json:"url"`
+	Suite      string   `json:"suite"`
+	Components []string `json:"components"`
+	KeyURL     string   `json:"key_url"`
+	// Insecure allows adding a repository without KeyURL where its packages
+	// would then be installed without signature checks.
+	Insecure bool `json:"insecure"`
+}
+
+var repoIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// validateRepository rejects ids that could escape the sources directory and
+// values that would break the line-based config files they are written to.
+func validateRepository(id string, values ...string) error {
+	if !repoIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid repository id %q", id)
+	}
+	for _, value := range values {
+		if strings.ContainsAny(value, " \t\r\n[]#") {
+			return fmt.Errorf("invalid repository value %q", value)
+		}
+	}
+	return nil
+}
+
+// checkSigningKey only accepts https key URLs. When required, i.e. when the
+// backend would install unsigned packages without a key, a missing key is
+// an error unless the repository is explicitly marked insecure.
+func checkSigningKey(spec RepositorySpec, required bool) error {
+	if spec.KeyURL != "" {
+		if !strings.HasPrefix(spec.KeyURL, "https://") {
+			return fmt.Errorf("key_url must be an https URL")
+		}
+		return nil
+	}
+	if required && !spec.Insecure {
+		return errors.New("key_url is required; set insecure to add the repository without signature checks")
+	}
+	return nil
+}
+
+// fetch downloads a signing key or vendor .repo file. Both are small, so the
+// body is read into memory. What is fetched decides which packages root
+// trusts, so only https is accepted.
+var fetch = func(url string) ([]byte, error) {
+	if !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("unsupported URL %q, only https is allowed", url)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+func removeFile(run Runner, path string) error {
+	_, err := run.run("sudo", "rm", "-f", path)
+	return err
+}
+
+// confSection is a "[name]" section of an INI-style file such as a dnf .repo
+// file or pacman.conf. Start is the header line and End is exclusive.
+type confSection struct {
+	Name       string
+	Start, End int
+	// Commented sections ("#[multilib]") are disabled pacman repositories.
+	// Their body is the run of commented lines right after the header.
+	Commented bool
+}
+
+// parseSections finds the sections of an INI-style file split into lines.
+// Comment lines just before a header belong to that header, so removing a
+// section leaves the next one's description in place.
+func parseSections(fileLines []string) []confSection {
+	var sections []confSection
+	for i, line := range fileLines {
+		trimmed := strings.TrimSpace(line)
+		commented := strings.HasPrefix(trimmed, "#")
+		header := strings.TrimSpace(strings.TrimPrefix(trimmed, "#"))
+		if !strings.HasPrefix(header, "[") || !strings.HasSuffix(header, "]") {
+			continue
+		}
+		sections = append(sections, confSection{
+			Name:      strings.TrimSuffix(strings.TrimPrefix(header, "["), "]"),
+			Start:     i,
+			Commented: commented,
+		})
+	}
+
+	for i := range sections {
+		s := &sections[i]
+		if s.Commented {
+			s.End = s.Start + 1
+			for s.End < len(fileLines) && strings.HasPrefix(strings.TrimSpace(fileLines[s.End]), "#") {
+				if i+1 < len(sections) && s.End == sections[i+1].Start {
+					break
+				}
+				s.End++
+			}
+			continue
+		}
+		s.End = len(fileLines)
+		if i+1 < len(sections) {
+			s.End = sections[i+1].Start
+		}
+		for s.End > s.Start+1 {
+			trimmed := strings.TrimSpace(fileLines[s.End-1])
+			if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+				break
+			}
+			s.End--
+		}
+	}
+	return sections
+}
+
+func findSection(sections []confSection, name string) (confSection, bool) {
+	for _, s := range sections {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return confSection{}, false
+}
+
+// sectionValues returns every value of key in a section, looking through
+// the comment markers of a disabled one.
+func sectionValues(fileLines []string, s confSection, key string) []string {
+	var values []string
+	for _, line := range fileLines[s.Start+1 : s.End] {
+		trimmed := strings.TrimSpace(line)
+		if s.Commented {
+			trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, "#"))
+		} else if strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		k, v, found := strings.Cut(trimmed, "=")
+		if found && strings.TrimSpace(k) == key {
+			values = append(values, strings.TrimSpace(v))
+		}
+	}
+	return values
+}
+
+func sectionValue(fileLines []string, s confSection, key string) string {
+	if values := sectionValues(fileLines, s, key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// setSectionValue replaces key in an uncommented section, or adds it after
+// the header when the section doesn't set it yet.
+func setSectionValue(fileLines []string, s confSection, key, value string) []string {
+	for i := s.Start + 1; i < s.End; i++ {
+		k, _, found := strings.Cut(strings.TrimSpace(fileLines[i]), "=")
+		if found && strings.TrimSpace(k) == key {
+			fileLines[i] = key + "=" + value
+			return fileLines
+		}
+	}
+	return append(fileLines[:s.Start+1], append([]string{key + "=" + value}, fileLines[s.Start+1:]...)...)
+}
+
+// removeSection deletes a section along with the blank line separating it
+// from its neighbours.
+func removeSection(fileLines []string, s confSection) []string {
+	start, end := s.Start, s.End
+	if start > 0 && strings.TrimSpace(fileLines[start-1]) == "" {
+		start--
+	} else if end < len(fileLines) && strings.TrimSpace(fileLines[end]) == "" {
+		end++
+	}
+	return append(fileLines[:start:start], fileLines[end:]...)
+}
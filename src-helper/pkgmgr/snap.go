@@ -0,0 +1,69 @@
+package pkgmgr
+
+import (
+	"regexp"
+	"strings"
+)
+
+// snap installs snaps from the Snap Store through snapd.
+type snap struct {
+	run Runner
+}
+
+func init() {
+	registerSource("snap", "snap", func(run Runner) AppSource { return &snap{run: run} })
+}
+
+func (s *snap) Name() string {
+	return "snap"
+}
+
+func (s *snap) Install(pkg string) (string, error) {
+	return s.run.run("sudo", "snap", "install", pkg)
+}
+
+func (s *snap) Remove(pkg string) (string, error) {
+	return s.run.run("sudo", "snap", "remove", pkg)
+}
+
+var snapColumns = regexp.MustCompile(`\s+`)
+
+func (s *snap) Search(query string) ([]SearchResult, error) {
+	out, err := s.run.run("snap", "find", query)
+	if err != nil {
+		// snap find exits non-zero when nothing matches
+		if strings.Contains(err.Error(), "No matching snaps") {
+			return []SearchResult{}, nil
+		}
+		return nil, err
+	}
+
+	// snap find prints a table: "Name  Version  Publisher  Notes  Summary"
+	results := []SearchResult{}
+	for i, line := range lines(out) {
+		cols := snapColumns.Split(strings.TrimSpace(line), 5)
+		if i == 0 || len(cols) < 5 {
+			continue
+		}
+		results = append(results, SearchResult{Name: cols[0], Description: cols[4]})
+	}
+	return results, nil
+}
+
+func (s *snap) ListInstalled() ([]InstalledPackage, error) {
+	out, err := s.run.run("snap", "list")
+	if err != nil {
+		return nil, err
+	}
+
+	// snap list prints a table: "Name  Version  Rev  Tracking  Publisher  Notes"
+	packages := []InstalledPackage{}
+	for i, line := range lines(out) {
+		fields := strings.Fields(line)
+		if i == 0 || len(fields) < 2 {
+			continue
+		}
+		packages = append(packages, InstalledPackage{Name: fields[0], Version: fields[1]})
+	}
+	return packages, nil
+}
@@ -0,0 +1,64 @@
+package pkgmgr
+
+import (
+	"os/exec"
+	"sort"
+
+	"piControlHelper/utils"
+)
+
+// AppSource is a distribution-independent package format such as Flatpak or
+// Snap. It installs alongside the native package manager rather than
+// replacing it.
+type AppSource interface {
+	// Name identifies the source in requests and results (flatpak, snap).
+	Name() string
+	Install(pkg string) (string, error)
+	Remove(pkg string) (string, error)
+	Search(query string) ([]SearchResult, error)
+	ListInstalled() ([]InstalledPackage, error)
+}
+
+type appSource struct {
+	binary  string
+	factory func(Runner) AppSource
+}
+
+var appSources = map[string]appSource{}
+
+// registerSource makes an app source available whenever binary is on PATH.
+// Sources call it from init.
+func registerSource(name, binary string, factory func(Runner) AppSource) {
+	appSources[name] = appSource{binary: binary, factory: factory}
+}
+
+// lookPath reports whether a source's tool is installed.
+var lookPath = exec.LookPath
+
+// Sources returns the app sources installed on this system, keyed by name,
+// using utils.RunCommand.
+func Sources() map[string]AppSource {
+	return SourcesWithRunner(utils.RunCommand)
+}
+
+// SourcesWithRunner returns the installed app sources using a custom
+// command runner.
+func SourcesWithRunner(run Runner) map[string]AppSource {
+	sources := map[string]AppSource{}
+	for name, source := range appSources {
+		if _, err := lookPath(source.binary); err == nil {
+			sources[name] = source.factory(run)
+		}
+	}
+	return sources
+}
+
+// SourceNames returns the names of sources in a stable order.
+func SourceNames(sources map[string]AppSource) []string {
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
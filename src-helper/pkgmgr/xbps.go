@@ -0,0 +1,216 @@
+package pkgmgr
+
+import (
+	"errors"
+	"strings"
+)
+
+// xbps backs Void Linux.
+type xbps struct {
+	run Runner
+}
+
+func init() {
+	register("void", func(run Runner) PackageManager { return &xbps{run: run} })
+}
+
+func (x *xbps) Name() string {
+	return "xbps"
+}
+
+func (x *xbps) Refresh() error {
+	_, err := x.run.run("sudo", "xbps-install", "-S")
+	return err
+}
+
+func (x *xbps) Install(pkg string) (string, error) {
+	return x.run.run("sudo", "xbps-install", "-y", pkg)
+}
+
+func (x *xbps) Versioned(pkg, version string) string {
+	return pkg + "-" + version
+}
+
+// InstallFile is not supported: xbps only installs from repositories, so a
+// local .xbps file needs an index built with xbps-rindex first.
+func (x *xbps) InstallFile(path string) (string, error) {
+	return "", errors.New("xbps can't install package files directly; add them to a local repository instead")
+}
+
+func (x *xbps) Remove(pkg string) (string, error) {
+	return x.run.run("sudo", "xbps-remove", "-y", pkg)
+}
+
+func (x *xbps) SimulateInstall(pkgs ...string) (*Transaction, error) {
+	return x.simulate("xbps-install", pkgs)
+}
+
+func (x *xbps) SimulateRemove(pkgs ...string) (*Transaction, error) {
+	return x.simulate("xbps-remove", pkgs)
+}
+
+// simulate runs the command with -n, which prints the transaction as
+// "pkgver action arch repository installedsize [downloadsize]".
+func (x *xbps) simulate(command string, pkgs []string) (*Transaction, error) {
+	args := append([]string{"-n"}, pkgs...)
+	out, err := x.run.run(command, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := newTransaction()
+	for _, line := range lines(out) {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		name, version := splitPkgver(fields[0], 1)
+		pkg := TransactionPackage{Name: name, Version: version}
+		size := parseSize(fields[4], 1)
+		switch fields[1] {
+		case "install":
+			tx.Install = append(tx.Install, pkg)
+			tx.DiskSize += size
+		case "update", "downgrade", "reinstall":
+			tx.Upgrade = append(tx.Upgrade, pkg)
+			tx.DiskSize += size
+		case "remove":
+			tx.Remove = append(tx.Remove, pkg)
+			tx.DiskSize -= size
+		}
+		if len(fields) > 5 {
+			tx.DownloadSize += parseSize(fields[5], 1)
+		}
+	}
+	return tx, nil
+}
+
+func (x *xbps) Search(query string) ([]SearchResult, error) {
+	out, err := x.run.run("xbps-query", "-Rs", query)
+	if err != nil {
+		return nil, err
+	}
+
+	// xbps-query -Rs prints "[-] name-1.2.3_1   description"
+	results := []SearchResult{}
+	for _, line := range lines(out) {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		name, _ := splitPkgver(fields[1], 1)
+		desc := strings.TrimSpace(strings.SplitN(line, fields[1], 2)[1])
+		results = append(results, SearchResult{Name: name, Description: desc})
+	}
+	return results, nil
+}
+
+// ListAvailable searches for "*", which xbps-query matches as a wildcard.
+func (x *xbps) ListAvailable() ([]SearchResult, error) {
+	return x.Search("*")
+}
+
+func (x *xbps) ListInstalled() ([]InstalledPackage, error) {
+	out, err := x.run.run("xbps-query", "-l")
+	if err != nil {
+		return nil, err
+	}
+
+	// xbps-query -l prints "ii name-1.2.3_1 description"
+	packages := []InstalledPackage{}
+	for _, line := range lines(out) {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		name, version := splitPkgver(fields[1], 1)
+		packages = append(packages, InstalledPackage{Name: name, Version: version})
+	}
+	return packages, nil
+}
+
+func (x *xbps) ListUpdates() ([]Update, error) {
+	// -n makes xbps-install a dry run that prints the transaction
+	out, err := x.run.run("xbps-install", "-Mnu")
+	if err != nil {
+		return nil, err
+	}
+
+	// Lines look like "name-1.1_1 update x86_64 <repo> ..."
+	current := installedVersions(x)
+	updates := []Update{}
+	for _, line := range lines(out) {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[1] != "update" {
+			continue
+		}
+		name, candidate := splitPkgver(fields[0], 1)
+		updates = append(updates, Update{Name: name, CurrentVersion: current[name], CandidateVersion: candidate})
+	}
+	return updates, nil
+}
+
+func (x *xbps) Upgrade(pkgs ...string) (string, error) {
+	args := append([]string{"xbps-install", "-Syu"}, pkgs...)
+	return x.run.run("sudo", args...)
+}
+
+func (x *xbps) Hold(pkg string) (string, error) {
+	return x.run.run("sudo", "xbps-pkgdb", "-m", "hold", pkg)
+}
+
+func (x *xbps) Unhold(pkg string) (string, error) {
+	return x.run.run("sudo", "xbps-pkgdb", "-m", "unhold", pkg)
+}
+
+func (x *xbps) ListHeld() ([]string, error) {
+	out, err := x.run.run("xbps-query", "--list-hold-pkgs")
+	if err != nil {
+		return nil, err
+	}
+	held := []string{}
+	for _, line := range lines(out) {
+		name, _ := splitPkgver(strings.TrimSpace(line), 1)
+		held = append(held, name)
+	}
+	return held, nil
+}
+
+func (x *xbps) Info(pkg string) (*PackageInfo, error) {
+	out, err := x.run.run("xbps-query", "-R", pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := parseFields(out)
+	name, version := splitPkgver(fields["pkgver"], 1)
+	info := &PackageInfo{
+		Name:                name,
+		Version:             version,
+		Description:         fields["short_desc"],
+		Repository:          fields["repository"],
+		DownloadSize:        parseSize(fields["filename-size"], 1),
+		InstalledSize:       parseSize(fields["installed_size"], 1),
+		Dependencies:        []string{},
+		ReverseDependencies: []string{},
+	}
+
+	if installed, err := x.run.run("xbps-query", "-p", "pkgver", pkg); err == nil {
+		_, info.InstalledVersion = splitPkgver(strings.TrimSpace(installed), 1)
+		info.Installed = true
+	}
+
+	// -x and -X print one pkgver per line
+	if deps, err := x.run.run("xbps-query", "-R", "-x", pkg); err == nil {
+		for _, dep := range lines(deps) {
+			info.Dependencies = append(info.Dependencies, depName(strings.TrimSpace(dep)))
+		}
+	}
+	if rdeps, err := x.run.run("xbps-query", "-X", pkg); err == nil {
+		for _, rdep := range lines(rdeps) {
+			name, _ := splitPkgver(strings.TrimSpace(rdep), 1)
+			info.ReverseDependencies = append(info.ReverseDependencies, name)
+		}
+	}
+	return info, nil
+}
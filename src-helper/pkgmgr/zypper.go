@@ -0,0 +1,237 @@
+package pkgmgr
+
+import (
+	"slices"
+	"strings"
+)
+
+// zypper backs openSUSE Leap and Tumbleweed.
+type zypper struct {
+	run Runner
+}
+
+func init() {
+	register("opensuse", func(run Runner) PackageManager { return &zypper{run: run} })
+}
+
+func (z *zypper) Name() string {
+	return "zypper"
+}
+
+func (z *zypper) Refresh() error {
+	_, err := z.run.run("sudo", "zypper", "--non-interactive", "refresh")
+	return err
+}
+
+func (z *zypper) Install(pkg string) (string, error) {
+	return z.run.run("sudo", "zypper", "--non-interactive", "install", pkg)
+}
+
+func (z *zypper) Versioned(pkg, version string) string {
+	return pkg + "=" + version
+}
+
+func (z *zypper) InstallFile(path string) (string, error) {
+	if err := checkPackageFile(z.Name(), path, ".rpm"); err != nil {
+		return "", err
+	}
+	// Internal builds are usually unsigned
+	return z.run.run("sudo", "zypper", "--non-interactive", "install", "--allow-unsigned-rpm", path)
+}
+
+func (z *zypper) Remove(pkg string) (string, error) {
+	return z.run.run("sudo", "zypper", "--non-interactive", "remove", pkg)
+}
+
+func (z *zypper) SimulateInstall(pkgs ...string) (*Transaction, error) {
+	return z.simulate("install", pkgs)
+}
+
+func (z *zypper) SimulateRemove(pkgs ...string) (*Transaction, error) {
+	return z.simulate("remove", pkgs)
+}
+
+// simulate runs zypper with --dry-run, which prints package names under
+// headings and a size summary:
+//
+//	The following 2 NEW packages are going to be installed:
+//	  htop libnl3-200
+//	Overall download size: 190.4 KiB. ... After the operation, additional 420.0 KiB will be used.
+func (z *zypper) simulate(action string, pkgs []string) (*Transaction, error) {
+	args := append([]string{"zypper", "--non-interactive", action, "--dry-run"}, pkgs...)
+	out, err := z.run.run("sudo", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := newTransaction()
+	var section *[]TransactionPackage
+	for _, line := range lines(out) {
+		if strings.HasPrefix(line, " ") {
+			if section != nil {
+				for _, name := range strings.Fields(line) {
+					*section = append(*section, TransactionPackage{Name: name})
+				}
+			}
+			continue
+		}
+		switch {
+		case strings.Contains(line, "going to be installed"), strings.Contains(line, "going to be reinstalled"):
+			section = &tx.Install
+		case strings.Contains(line, "going to be upgraded"), strings.Contains(line, "going to be downgraded"):
+			section = &tx.Upgrade
+		case strings.Contains(line, "going to be REMOVED"):
+			section = &tx.Remove
+		default:
+			section = nil
+		}
+		if size := between(line, "Overall download size: ", "."); size != "" {
+			tx.DownloadSize = parseSize(size, 1)
+		}
+		if size := between(line, "additional ", " will be used"); size != "" {
+			tx.DiskSize = parseSize(size, 1)
+		}
+		if size := between(line, "After the operation, ", " will be freed"); size != "" {
+			tx.DiskSize = -parseSize(size, 1)
+		}
+	}
+	return tx, nil
+}
+
+func (z *zypper) Search(query string) ([]SearchResult, error) {
+	out, err := z.run.run("zypper", "--non-interactive", "--quiet", "search", query)
+	if err != nil {
+		return nil, err
+	}
+
+	// zypper prints a table: "S | Name | Summary | Type"
+	results := []SearchResult{}
+	for _, line := range lines(out) {
+		cols := strings.Split(line, "|")
+		if len(cols) < 3 {
+			continue
+		}
+		name := strings.TrimSpace(cols[1])
+		if name == "" || name == "Name" || strings.HasPrefix(name, "-") {
+			continue
+		}
+		results = append(results, SearchResult{Name: name, Description: strings.TrimSpace(cols[2])})
+	}
+	return results, nil
+}
+
+// ListAvailable searches for "*", which zypper expands as a wildcard.
+func (z *zypper) ListAvailable() ([]SearchResult, error) {
+	return z.Search("*")
+}
+
+func (z *zypper) ListInstalled() ([]InstalledPackage, error) {
+	return listRPM(z.run)
+}
+
+func (z *zypper) ListUpdates() ([]Update, error) {
+	out, err := z.run.run("zypper", "--non-interactive", "--quiet", "list-updates")
+	if err != nil {
+		return nil, err
+	}
+
+	// zypper prints a table:
+	// "S | Repository | Name | Current Version | Available Version | Arch"
+	updates := []Update{}
+	for _, line := range lines(out) {
+		cols := strings.Split(line, "|")
+		if len(cols) < 5 {
+			continue
+		}
+		name := strings.TrimSpace(cols[2])
+		if name == "" || name == "Name" || strings.HasPrefix(name, "-") {
+			continue
+		}
+		updates = append(updates, Update{
+			Name:             name,
+			CurrentVersion:   strings.TrimSpace(cols[3]),
+			CandidateVersion: strings.TrimSpace(cols[4]),
+		})
+	}
+	return updates, nil
+}
+
+func (z *zypper) Upgrade(pkgs ...string) (string, error) {
+	args := append([]string{"zypper", "--non-interactive", "update"}, pkgs...)
+	return z.run.run("sudo", args...)
+}
+
+func (z *zypper) Hold(pkg string) (string, error) {
+	return z.run.run("sudo", "zypper", "--non-interactive", "addlock", pkg)
+}
+
+func (z *zypper) Unhold(pkg string) (string, error) {
+	return z.run.run("sudo", "zypper", "--non-interactive", "removelock", pkg)
+}
+
+func (z *zypper) ListHeld() ([]string, error) {
+	out, err := z.run.run("zypper", "--non-interactive", "--quiet", "locks")
+	if err != nil {
+		return nil, err
+	}
+
+	// zypper prints a table: "# | Name | Type | Repository"
+	held := []string{}
+	for _, line := range lines(out) {
+		cols := strings.Split(line, "|")
+		if len(cols) < 2 {
+			continue
+		}
+		name := strings.TrimSpace(cols[1])
+		if name == "" || name == "Name" || strings.HasPrefix(name, "-") {
+			continue
+		}
+		held = append(held, name)
+	}
+	return held, nil
+}
+
+func (z *zypper) Info(pkg string) (*PackageInfo, error) {
+	out, err := z.run.run("zypper", "--non-interactive", "info", "--requires", pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := parseFields(out)
+	info := &PackageInfo{
+		Name:          fields["Name"],
+		Version:       fields["Version"],
+		Description:   fields["Summary"],
+		Repository:    fields["Repository"],
+		InstalledSize: parseSize(fields["Installed Size"], 1),
+		Installed:     strings.HasPrefix(fields["Installed"], "Yes"),
+		Dependencies:  []string{},
+	}
+
+	// Requirements follow "Requires : [n]" as indented lines
+	inRequires := false
+	for _, line := range lines(out) {
+		if !strings.HasPrefix(line, " ") {
+			inRequires = strings.HasPrefix(line, "Requires")
+			continue
+		}
+		if inRequires {
+			dep := depName(strings.TrimSpace(line))
+			if !slices.Contains(info.Dependencies, dep) {
+				info.Dependencies = append(info.Dependencies, dep)
+			}
+		}
+	}
+
+	if info.Installed {
+		if version, err := z.run.run("rpm", "-q", "--qf", "%{VERSION}-%{RELEASE}", pkg); err == nil {
+			info.InstalledVersion = strings.TrimSpace(version)
+		}
+	}
+
+	info.ReverseDependencies = []string{}
+	if rdepends, err := z.run.run("rpm", "-q", "--whatrequires", pkg, "--qf", "%{NAME}\n"); err == nil {
+		info.ReverseDependencies = append(info.ReverseDependencies, lines(rdepends)...)
+	}
+	return info, nil
+}
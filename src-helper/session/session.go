@@ -0,0 +1,257 @@
+// Package session stores the helper's login sessions.
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"piControlHelper/utils"
+)
+
+type Session struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is pushed back while the session is used.
+	ExpiresAt time.Time `json:"expires_at"`
+	// MaxExpiresAt is when the session ends however much it is used or
+	// refreshed. Until then an idle session can still be refreshed.
+	MaxExpiresAt time.Time `json:"max_expires_at"`
+	// RefreshHash is the SHA-256 hash of the session's refresh token.
+	RefreshHash string `json:"refresh_hash,omitempty"`
+}
+
+// Ended reports whether the session can neither be used nor refreshed.
+func (s Session) Ended(now time.Time) bool {
+	return now.After(s.ExpiresAt) && (s.MaxExpiresAt.IsZero() || now.After(s.MaxExpiresAt))
+}
+
+// Store keeps sessions by ID. Implementations are safe for concurrent use.
+// Get returns copies, so callers change a session by putting it back.
+type Store interface {
+	Get(id string) (Session, bool)
+	Put(s Session) error
+	Delete(id string) error
+	// DeleteAll logs everybody out.
+	DeleteAll() error
+	// DeleteUser logs a user out of all their sessions.
+	DeleteUser(user string) error
+	// DeleteExpired removes the sessions that ended before now and returns
+	// how many there were.
+	DeleteExpired(now time.Time) (int, error)
+	Count() int
+}
+
+// MemoryStore keeps sessions in memory. They are lost on restart.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	sessions map[string]Session
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: map[string]Session{}}
+}
+
+func (m *MemoryStore) Get(id string) (Session, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.sessions[id]
+	return s, ok
+}
+
+func (m *MemoryStore) Put(s Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[s.ID] = s
+	return nil
+}
+
+func (m *MemoryStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *MemoryStore) DeleteAll() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions = map[string]Session{}
+	return nil
+}
+
+func (m *MemoryStore) DeleteUser(user string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deleteUser(m.sessions, user)
+	return nil
+}
+
+func (m *MemoryStore) DeleteExpired(now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return deleteExpired(m.sessions, now), nil
+}
+
+func (m *MemoryStore) Count() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.sessions)
+}
+
+func deleteUser(sessions map[string]Session, user string) int {
+	removed := 0
+	for id, s := range sessions {
+		if s.User == user {
+			delete(sessions, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+func deleteExpired(sessions map[string]Session, now time.Time) int {
+	removed := 0
+	for id, s := range sessions {
+		if s.Ended(now) {
+			delete(sessions, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// FileStore keeps sessions in a JSON file, so logins survive a restart of
+// the helper. The file is rewritten on every change, which is fine for the
+// handful of sessions a device has.
+//
+// Session IDs are bearer tokens, so the file only holds their SHA-256
+// hashes: a copy of it can't be used to log in.
+type FileStore struct {
+	path string
+
+	mu sync.RWMutex
+	// sessions is keyed by hashed ID, and the sessions' IDs are hashed too
+	sessions map[string]Session
+}
+
+// NewFileStore loads the sessions saved at path. A missing file is not an
+// error; it is created on the first login.
+func NewFileStore(path string) (*FileStore, error) {
+	f := &FileStore{path: path, sessions: map[string]Session{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session file: %v", err)
+	}
+	var saved []Session
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse session file: %v", err)
+	}
+	for _, s := range saved {
+		f.sessions[s.ID] = s
+	}
+	return f, nil
+}
+
+func hashID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+func (f *FileStore) Get(id string) (Session, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	s, ok := f.sessions[hashID(id)]
+	s.ID = id
+	return s, ok
+}
+
+func (f *FileStore) Put(s Session) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s.ID = hashID(s.ID)
+	f.sessions[s.ID] = s
+	return f.save()
+}
+
+func (f *FileStore) Delete(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.sessions, hashID(id))
+	return f.save()
+}
+
+func (f *FileStore) DeleteAll() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sessions = map[string]Session{}
+	return f.save()
+}
+
+func (f *FileStore) DeleteUser(user string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if deleteUser(f.sessions, user) == 0 {
+		return nil
+	}
+	return f.save()
+}
+
+func (f *FileStore) DeleteExpired(now time.Time) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	removed := deleteExpired(f.sessions, now)
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, f.save()
+}
+
+func (f *FileStore) Count() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.sessions)
+}
+
+// save writes the sessions atomically. The caller holds f.mu.
+func (f *FileStore) save() error {
+	saved := make([]Session, 0, len(f.sessions))
+	for _, s := range f.sessions {
+		saved = append(saved, s)
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(f.path, data)
+}
+
+// StartJanitor removes ended sessions from store every interval until
+// stop is called.
+func StartJanitor(store Store, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if _, err := store.DeleteExpired(now); err != nil {
+					log.Println("Failed to remove expired sessions:", err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -28,7 +28,9 @@ if [ "$1" = "--show-qr" ] || [ "$1" = "--qr" ]; then
     # Function to display TOTP QR code from existing configuration
     display_existing_totp_qr() {
         local config_dir="/opt/picontrol-helper/config"
-        local secret_file="$config_dir/totp_secret.json"
+        local secret_file="$config_dir/users.json"
+        # Installs from before user accounts, until the helper migrates them
+        [ -f "$secret_file" ] || secret_file="$config_dir/totp_secret.json"
         
         if [ ! -f "$secret_file" ]; then
             echo_warning "No existing TOTP configuration found at $secret_file"
@@ -38,17 +40,18 @@ if [ "$1" = "--show-qr" ] || [ "$1" = "--qr" ]; then
         
         echo_info "Found existing TOTP configuration, displaying QR code..."
         
-        # Extract secret from JSON file
+        # Extract secret from JSON file. users.json lists the admin account
+        # created at setup first; other users get their QR code from the API.
         if command -v jq &> /dev/null; then
             # Use jq if available
-            SECRET=$(jq -r '.secret' "$secret_file" 2>/dev/null)
-            ACCOUNT_NAME=$(jq -r '.account_name' "$secret_file" 2>/dev/null)
-            ISSUER=$(jq -r '.issuer' "$secret_file" 2>/dev/null)
+            SECRET=$(jq -r 'if type == "array" then .[0] else . end | .secret' "$secret_file" 2>/dev/null)
+            ACCOUNT_NAME=$(jq -r 'if type == "array" then .[0] else . end | .account_name' "$secret_file" 2>/dev/null)
+            ISSUER=$(jq -r 'if type == "array" then .[0] else . end | .issuer' "$secret_file" 2>/dev/null)
         else
             # Fallback to grep/sed parsing
-            SECRET=$(grep '"secret"' "$secret_file" | sed 's/.*"secret"[[:space:]]*:[[:space:]]*"\([^"]*\)".*/\1/')
-            ACCOUNT_NAME=$(grep '"account_name"' "$secret_file" | sed 's/.*"account_name"[[:space:]]*:[[:space:]]*"\([^"]*\)".*/\1/')
-            ISSUER=$(grep '"issuer"' "$secret_file" | sed 's/.*"issuer"[[:space:]]*:[[:space:]]*"\([^"]*\)".*/\1/')
+            SECRET=$(grep -m1 '"secret"' "$secret_file" | sed 's/.*"secret"[[:space:]]*:[[:space:]]*"\([^"]*\)".*/\1/')
+            ACCOUNT_NAME=$(grep -m1 '"account_name"' "$secret_file" | sed 's/.*"account_name"[[:space:]]*:[[:space:]]*"\([^"]*\)".*/\1/')
+            ISSUER=$(grep -m1 '"issuer"' "$secret_file" | sed 's/.*"issuer"[[:space:]]*:[[:space:]]*"\([^"]*\)".*/\1/')
         fi
         
         if [ -z "$SECRET" ] || [ "$SECRET" = "null" ]; then
@@ -226,10 +229,24 @@ install_packages() {
             ;;
         fedora|rhel|centos)
             dnf install -y git curl gcc make qrencode
+            # Package holds use versionlock, a plugin on dnf 4 and built into dnf 5
+            if ! dnf versionlock --help &> /dev/null; then
+                dnf install -y python3-dnf-plugin-versionlock || dnf install -y dnf-plugin-versionlock || \
+                    echo_warning "Could not install the dnf versionlock plugin; package holds will be unavailable"
+            fi
             ;;
         arch|manjaro)
             pacman -Sy --noconfirm git curl base-devel qrencode
             ;;
+        opensuse*|sles|sled)
+            zypper --non-interactive install git curl gcc make qrencode
+            ;;
+        alpine)
+            apk add git curl build-base libqrencode-tools
+            ;;
+        void)
+            xbps-install -Sy git curl base-devel qrencode
+            ;;
         *)
             echo_error "Unsupported distribution: $DISTRO"
             echo_info "Please manually install: git, curl, build-essential, qrencode"
@@ -399,6 +416,13 @@ else
     echo_info "User $CURRENT_USER is already in the pkgmanagers group"
 fi
 
+# Reading service logs needs access to the system journal
+if getent group systemd-journal > /dev/null && ! id -nG "$CURRENT_USER" | grep -qw "systemd-journal"; then
+    echo_info "Adding $CURRENT_USER to systemd-journal group..."
+    usermod -aG systemd-journal "$CURRENT_USER"
+    echo_success "User added to 'systemd-journal' group"
+fi
+
 # Build the sudoers configuration based on the distribution
 SUDOERS_CONF="/etc/sudoers.d/pkgmanagers"
 SUDOERS_CONTENT="# Package management permissions for pkgmanagers group\n"
@@ -409,12 +433,28 @@ SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /bin/systemctl restart *\n"
 SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /bin/systemctl enable *\n"
 SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /bin/systemctl disable *\n"
 SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /bin/systemctl status *\n"
+SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /bin/systemctl reload *\n"
+SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /bin/systemctl mask *\n"
+SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /bin/systemctl unmask *\n"
+SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /bin/systemctl reset-failed *\n"
 SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/systemctl start *\n"
 SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/systemctl stop *\n"
 SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/systemctl restart *\n"
 SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/systemctl enable *\n"
 SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/systemctl disable *\n"
 SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/systemctl status *\n"
+SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/systemctl reload *\n"
+SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/systemctl mask *\n"
+SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/systemctl unmask *\n"
+SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/systemctl reset-failed *\n"
+SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /bin/systemctl daemon-reload\n"
+SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/systemctl daemon-reload\n"
+SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/install -D -m 0644 /tmp/picontrol-* /etc/systemd/system/*\n"
+SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/rm -f /etc/systemd/system/*\n"
+SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/flatpak install --system *\n"
+SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/flatpak uninstall --system *\n"
+SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/snap install *\n"
+SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/snap remove *\n"
 
 case $DISTRO in
     debian|ubuntu|pop|linuxmint)
@@ -422,21 +462,64 @@ case $DISTRO in
         SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/apt-get update\n"
         SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/apt-get install *\n"
         SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/apt-get remove *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/apt-get upgrade *\n"
         SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/apt update\n"
         SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/apt install *\n"
         SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/apt remove *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/apt-mark hold *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/apt-mark unhold *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/install -D -m 0644 /tmp/picontrol-* /etc/apt/sources.list.d/*\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/install -D -m 0644 /tmp/picontrol-* /etc/apt/keyrings/*\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/rm -f /etc/apt/sources.list.d/*\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/rm -f /etc/apt/keyrings/*\n"
         ;;
     fedora|rhel|centos)
         echo_info "Configuring for Fedora/RHEL-based system"
         SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/dnf install *\n"
         SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/dnf remove *\n"
         SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/dnf update *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/dnf upgrade *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/dnf versionlock *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/install -D -m 0644 /tmp/picontrol-* /etc/yum.repos.d/*\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/rm -f /etc/yum.repos.d/*\n"
         ;;
     arch|manjaro)
         echo_info "Configuring for Arch-based system"
         SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/pacman -S *\n"
         SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/pacman -R *\n"
         SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/pacman -Syu *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/pacman -U *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/install -D -m 0644 /tmp/picontrol-* /etc/pacman.conf\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/pacman-key --add /tmp/picontrol-*\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/pacman-key --lsign-key *\n"
+        ;;
+    opensuse*|sles|sled)
+        echo_info "Configuring for openSUSE/SUSE-based system"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/zypper --non-interactive refresh\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/zypper --non-interactive install *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/zypper --non-interactive remove *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/zypper --non-interactive update\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/zypper --non-interactive update *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/zypper --non-interactive addlock *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/zypper --non-interactive removelock *\n"
+        ;;
+    alpine)
+        echo_info "Configuring for Alpine Linux"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /sbin/apk update\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /sbin/apk add *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /sbin/apk del *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /sbin/apk upgrade\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /sbin/apk upgrade *\n"
+        ;;
+    void)
+        echo_info "Configuring for Void Linux"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/xbps-install -S\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/xbps-install -y *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/xbps-install -Syu\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/xbps-install -Syu *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/xbps-remove -y *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/xbps-pkgdb -m hold *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/xbps-pkgdb -m unhold *\n"
         ;;
     *)
         echo_info "Unknown distribution, adding common package managers"
@@ -444,6 +527,11 @@ case $DISTRO in
         SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/apt *\n"
         SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/dnf *\n"
         SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/pacman *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/zypper *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /sbin/apk *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/xbps-install *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/xbps-remove *\n"
+        SUDOERS_CONTENT+="%pkgmanagers ALL=(ALL) NOPASSWD: /usr/bin/xbps-pkgdb *\n"
         ;;
 esac
 
@@ -604,10 +692,11 @@ fi
 
 echo_success "======================================================"
 echo_success "PiControl Helper setup completed successfully!"
-echo_success "The service is running at: http://localhost:8220"
+echo_success "The service is running at: https://localhost:8220"
+echo_success "  🔒 Self-signed certificate: /opt/picontrol-helper/config/tls_cert.pem"
 echo_success ""
 echo_success "🔐 AUTHENTICATION SETUP:"
-if [ -f "/opt/picontrol-helper/config/totp_secret.json" ]; then
+if [ -f "/opt/picontrol-helper/config/users.json" ] || [ -f "/opt/picontrol-helper/config/totp_secret.json" ]; then
     echo_success "  ✅ TOTP already configured (QR code displayed above)"
     echo_success "  🔄 To display QR code again: $0 --show-qr"
 else
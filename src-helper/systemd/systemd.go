@@ -0,0 +1,260 @@
+// Package systemd reads unit state from systemd over D-Bus
+// (org.freedesktop.systemd1). Unlike systemctl output, the values are typed
+// and don't depend on the locale or on column widths.
+package systemd
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	destination      = "org.freedesktop.systemd1"
+	managerPath      = "/org/freedesktop/systemd1"
+	managerInterface = destination + ".Manager"
+	unitInterface    = destination + ".Unit"
+)
+
+// ErrUnitNotFound is returned when no unit file exists for a unit name.
+var ErrUnitNotFound = errors.New("unit not found")
+
+// Unit is a loaded unit as listed by ListUnits.
+type Unit struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	LoadState   string `json:"load_state"`
+	ActiveState string `json:"active_state"`
+	SubState    string `json:"sub_state"`
+	Description string `json:"description"`
+}
+
+// ExecCommand is one command of a service's ExecStart.
+type ExecCommand struct {
+	Path string   `json:"path"`
+	Argv []string `json:"argv"`
+}
+
+// Dependencies lists the units a unit is related to, by relation.
+type Dependencies struct {
+	Requires    []string `json:"requires"`
+	Wants       []string `json:"wants"`
+	BindsTo     []string `json:"binds_to"`
+	Conflicts   []string `json:"conflicts"`
+	After       []string `json:"after"`
+	Before      []string `json:"before"`
+	RequiredBy  []string `json:"required_by"`
+	WantedBy    []string `json:"wanted_by"`
+	Triggers    []string `json:"triggers"`
+	TriggeredBy []string `json:"triggered_by"`
+}
+
+// UnitStatus is the detailed state of a single unit. Fields systemd doesn't
+// track for the unit type, or doesn't know (e.g. memory without accounting),
+// are left empty.
+type UnitStatus struct {
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	Description   string `json:"description"`
+	LoadState     string `json:"load_state"`
+	ActiveState   string `json:"active_state"`
+	SubState      string `json:"sub_state"`
+	UnitFileState string `json:"unit_file_state"`
+	// UnitFile is the path of the unit file the unit was loaded from.
+	UnitFile             string        `json:"unit_file"`
+	DropIns              []string      `json:"drop_ins"`
+	ActiveEnterTimestamp *time.Time    `json:"active_enter_timestamp,omitempty"`
+	MainPID              uint32        `json:"main_pid,omitempty"`
+	MemoryBytes          *uint64       `json:"memory_bytes,omitempty"`
+	CPUTimeNSec          *uint64       `json:"cpu_time_nsec,omitempty"`
+	Restarts             *uint32       `json:"restarts,omitempty"`
+	ExecStart            []ExecCommand `json:"exec_start,omitempty"`
+	Dependencies         Dependencies  `json:"dependencies"`
+}
+
+// UnitType returns the suffix of a unit name, e.g. "timer" for "backup.timer".
+func UnitType(name string) string {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// manager connects to the shared system bus, which godbus reconnects if the
+// connection was lost.
+func manager() (*dbus.Conn, dbus.BusObject, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, conn.Object(destination, managerPath), nil
+}
+
+// ListUnits returns the loaded units of the given types, active or not,
+// sorted by name.
+func ListUnits(types ...string) ([]Unit, error) {
+	_, obj, err := manager()
+	if err != nil {
+		return nil, err
+	}
+
+	// ListUnits returns a(ssssssouso): name, description, load state,
+	// active state, sub state, followed unit, object path and queued job
+	var listed []struct {
+		Name, Description, LoadState, ActiveState, SubState, Following string
+		Path                                                           dbus.ObjectPath
+		JobID                                                          uint32
+		JobType                                                        string
+		JobPath                                                        dbus.ObjectPath
+	}
+	if err := obj.Call(managerInterface+".ListUnits", 0).Store(&listed); err != nil {
+		return nil, err
+	}
+
+	units := []Unit{}
+	for _, u := range listed {
+		unitType := UnitType(u.Name)
+		if len(types) > 0 && !slices.Contains(types, unitType) {
+			continue
+		}
+		units = append(units, Unit{
+			Name:        u.Name,
+			Type:        unitType,
+			LoadState:   u.LoadState,
+			ActiveState: u.ActiveState,
+			SubState:    u.SubState,
+			Description: u.Description,
+		})
+	}
+	sort.Slice(units, func(i, k int) bool { return units[i].Name < units[k].Name })
+	return units, nil
+}
+
+// GetUnitStatus loads the unit if needed and reads its properties.
+func GetUnitStatus(name string) (*UnitStatus, error) {
+	conn, obj, err := manager()
+	if err != nil {
+		return nil, err
+	}
+
+	// LoadUnit, unlike GetUnit, also works for inactive units that systemd
+	// has unloaded
+	var path dbus.ObjectPath
+	if err := obj.Call(managerInterface+".LoadUnit", 0, name).Store(&path); err != nil {
+		return nil, err
+	}
+	unit, err := properties(conn, path, unitInterface)
+	if err != nil {
+		return nil, err
+	}
+	if str(unit, "LoadState") == "not-found" {
+		return nil, ErrUnitNotFound
+	}
+
+	status := &UnitStatus{
+		Name:                 str(unit, "Id"),
+		Type:                 UnitType(str(unit, "Id")),
+		Description:          str(unit, "Description"),
+		LoadState:            str(unit, "LoadState"),
+		ActiveState:          str(unit, "ActiveState"),
+		SubState:             str(unit, "SubState"),
+		UnitFileState:        str(unit, "UnitFileState"),
+		UnitFile:             str(unit, "FragmentPath"),
+		DropIns:              strs(unit, "DropInPaths"),
+		ActiveEnterTimestamp: timestamp(unit, "ActiveEnterTimestamp"),
+		Dependencies: Dependencies{
+			Requires:    strs(unit, "Requires"),
+			Wants:       strs(unit, "Wants"),
+			BindsTo:     strs(unit, "BindsTo"),
+			Conflicts:   strs(unit, "Conflicts"),
+			After:       strs(unit, "After"),
+			Before:      strs(unit, "Before"),
+			RequiredBy:  strs(unit, "RequiredBy"),
+			WantedBy:    strs(unit, "WantedBy"),
+			Triggers:    strs(unit, "Triggers"),
+			TriggeredBy: strs(unit, "TriggeredBy"),
+		},
+	}
+
+	// Process and resource properties live on the type-specific interface,
+	// and only unit types that run processes have them
+	if !slices.Contains([]string{"service", "socket", "mount"}, status.Type) {
+		return status, nil
+	}
+	typed, err := properties(conn, path, destination+"."+strings.ToUpper(status.Type[:1])+status.Type[1:])
+	if err != nil {
+		return nil, err
+	}
+	status.MemoryBytes = counter(typed, "MemoryCurrent")
+	status.CPUTimeNSec = counter(typed, "CPUUsageNSec")
+	if pid, ok := typed["MainPID"].Value().(uint32); ok {
+		status.MainPID = pid
+	}
+	if restarts, ok := typed["NRestarts"].Value().(uint32); ok {
+		status.Restarts = &restarts
+	}
+	status.ExecStart = execCommands(typed, "ExecStart")
+	return status, nil
+}
+
+func properties(conn *dbus.Conn, path dbus.ObjectPath, iface string) (map[string]dbus.Variant, error) {
+	props := map[string]dbus.Variant{}
+	err := conn.Object(destination, path).Call("org.freedesktop.DBus.Properties.GetAll", 0, iface).Store(&props)
+	return props, err
+}
+
+func str(props map[string]dbus.Variant, key string) string {
+	s, _ := props[key].Value().(string)
+	return s
+}
+
+func strs(props map[string]dbus.Variant, key string) []string {
+	if values, ok := props[key].Value().([]string); ok {
+		return values
+	}
+	return []string{}
+}
+
+// timestamp converts a microsecond timestamp, where 0 means never.
+func timestamp(props map[string]dbus.Variant, key string) *time.Time {
+	usec, ok := props[key].Value().(uint64)
+	if !ok || usec == 0 {
+		return nil
+	}
+	t := time.UnixMicro(int64(usec))
+	return &t
+}
+
+// counter returns a resource counter. systemd reports the maximum value when
+// accounting is disabled for the unit.
+func counter(props map[string]dbus.Variant, key string) *uint64 {
+	value, ok := props[key].Value().(uint64)
+	if !ok || value == math.MaxUint64 {
+		return nil
+	}
+	return &value
+}
+
+// execCommands decodes an a(sasbttttuii) exec property. Only the path and
+// argv of each command are kept; the rest describes the last run.
+func execCommands(props map[string]dbus.Variant, key string) []ExecCommand {
+	entries, ok := props[key].Value().([][]any)
+	if !ok {
+		return nil
+	}
+	commands := []ExecCommand{}
+	for _, entry := range entries {
+		if len(entry) < 2 {
+			continue
+		}
+		path, _ := entry[0].(string)
+		argv, _ := entry[1].([]string)
+		commands = append(commands, ExecCommand{Path: path, Argv: argv})
+	}
+	return commands
+}
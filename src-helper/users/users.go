@@ -0,0 +1,199 @@
+// Package users stores the helper's user accounts. Every user logs in with
+// their own TOTP secret and has a role that limits what they may do.
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"piControlHelper/utils"
+)
+
+// Role is what a user may do. Each role includes the ones below it.
+type Role string
+
+const (
+	// Viewer can read status, lists and logs.
+	Viewer Role = "viewer"
+	// Operator can also control services.
+	Operator Role = "operator"
+	// Admin can also manage packages, unit files, users and TOTP secrets.
+	Admin Role = "admin"
+)
+
+var roleRanks = map[Role]int{Viewer: 1, Operator: 2, Admin: 3}
+
+// Valid reports whether r is a known role.
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// Allows reports whether r includes the required role.
+func (r Role) Allows(required Role) bool {
+	return r.Valid() && roleRanks[r] >= roleRanks[required]
+}
+
+type User struct {
+	Name        string    `json:"name"`
+	Role        Role      `json:"role"`
+	Secret      string    `json:"secret"`
+	AccountName string    `json:"account_name"`
+	Issuer      string    `json:"issuer"`
+	CreatedAt   time.Time `json:"created_at"`
+	// LastUsedStep is the TOTP time step of the user's last accepted code.
+	LastUsedStep int64 `json:"last_used_step,omitempty"`
+	// Rotation is a new secret that hasn't been confirmed yet.
+	Rotation *Rotation `json:"rotation,omitempty"`
+}
+
+// Rotation is a new TOTP secret waiting to be confirmed with a code from it.
+// Until then the user's current secret stays in use, so a QR code that
+// never reaches the authenticator app doesn't lock them out.
+type Rotation struct {
+	Secret      string    `json:"secret"`
+	AccountName string    `json:"account_name"`
+	Issuer      string    `json:"issuer"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+var (
+	ErrNotFound = errors.New("user not found")
+	ErrExists   = errors.New("user already exists")
+)
+
+var namePattern = regexp.MustCompile(`^[a-z][a-z0-9._-]{0,31}$`)
+
+// ValidName reports whether name can be used as a user name: lower case
+// letters, digits, ".", "_" and "-", starting with a letter.
+func ValidName(name string) bool {
+	return namePattern.MatchString(name)
+}
+
+// Store keeps the users in a JSON file that only the helper can read, since
+// it holds the TOTP secrets. It is safe for concurrent use.
+type Store struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+// Open loads the users saved at path. A missing file is not an error; it is
+// created when the first user is added.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, users: map[string]User{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read users file: %v", err)
+	}
+	var saved []User
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse users file: %v", err)
+	}
+	for _, u := range saved {
+		s.users[u.Name] = u
+	}
+	return s, nil
+}
+
+func (s *Store) Get(name string) (User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[name]
+	return u, ok
+}
+
+// List returns the users in the order they were created.
+func (s *Store) List() []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sorted()
+}
+
+// Add creates a user, failing with ErrExists if the name is taken.
+func (s *Store) Add(u User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[u.Name]; ok {
+		return ErrExists
+	}
+	s.users[u.Name] = u
+	return s.save()
+}
+
+// Update changes an existing user, failing with ErrNotFound if there is
+// none by that name.
+func (s *Store) Update(name string, change func(u *User)) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[name]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	change(&u)
+	s.users[name] = u
+	return u, s.save()
+}
+
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[name]; !ok {
+		return ErrNotFound
+	}
+	delete(s.users, name)
+	return s.save()
+}
+
+func (s *Store) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.users)
+}
+
+// CountRole returns how many users have the role.
+func (s *Store) CountRole(role Role) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	count := 0
+	for _, u := range s.users {
+		if u.Role == role {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *Store) sorted() []User {
+	list := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, k int) bool {
+		if !list[i].CreatedAt.Equal(list[k].CreatedAt) {
+			return list[i].CreatedAt.Before(list[k].CreatedAt)
+		}
+		return list[i].Name < list[k].Name
+	})
+	return list
+}
+
+// save writes the users atomically, oldest first, so the account created at
+// setup comes first in the file. The caller holds s.mu.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(s.path, data)
+}
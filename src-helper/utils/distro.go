@@ -3,10 +3,12 @@ package utils
 import (
 	"bufio"
 	"bytes"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 )
 
 func IdentifyDistro() string {
@@ -27,6 +29,12 @@ func IdentifyDistro() string {
 	switch {
 	case strings.Contains(lower, "fedora"):
 		return "fedora"
+	case strings.Contains(lower, "suse"):
+		return "opensuse"
+	case strings.Contains(lower, "alpine"):
+		return "alpine"
+	case strings.Contains(lower, "void"):
+		return "void"
 	case strings.Contains(lower, "arch"):
 		return "arch"
 	case strings.Contains(lower, "ubuntu") || strings.Contains(lower, "debian") || strings.Contains(lower, "mint") || strings.Contains(lower, "pop"):
@@ -36,6 +44,25 @@ func IdentifyDistro() string {
 	}
 }
 
+// OSRelease returns the KEY=value pairs of /etc/os-release with quotes
+// removed, e.g. VERSION_CODENAME for building apt sources.
+func OSRelease() map[string]string {
+	fields := map[string]string{}
+	data, err := os.ReadFile("/etc/os-release")
+	if err != nil {
+		log.Println("Error reading /etc/os-release:", err)
+		return fields
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		if !found || strings.HasPrefix(key, "#") {
+			continue
+		}
+		fields[key] = strings.Trim(value, `"'`)
+	}
+	return fields
+}
+
 func RunCommand(cmdName string, args ...string) (string, string, error) {
 	cmd := exec.Command(cmdName, args...)
 	var stdout, stderr bytes.Buffer
@@ -44,3 +71,47 @@ func RunCommand(cmdName string, args ...string) (string, string, error) {
 	err := cmd.Run()
 	return stdout.String(), stderr.String(), err
 }
+
+// maxStreamLine is the longest line StreamCommand reports.
+const maxStreamLine = 1024 * 1024
+
+// StreamCommand runs a command like RunCommand, but also calls onLine for every
+// line written to stdout or stderr as it arrives. onLine may be called from two
+// goroutines at once and must synchronise its own writes.
+func StreamCommand(onLine func(stream, line string), cmdName string, args ...string) (string, string, error) {
+	cmd := exec.Command(cmdName, args...)
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", "", err
+	}
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		return "", "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", "", err
+	}
+
+	var stdout, stderr bytes.Buffer
+	var wg sync.WaitGroup
+	collect := func(stream string, r io.Reader, buf *bytes.Buffer) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), maxStreamLine)
+		for scanner.Scan() {
+			line := scanner.Text()
+			buf.WriteString(line + "\n")
+			onLine(stream, line)
+		}
+		// A line past the limit stops the scanner. The rest is drained so the
+		// command can't block on a full pipe and hang cmd.Wait.
+		io.Copy(io.Discard, r)
+	}
+	wg.Add(2)
+	go collect("stdout", stdoutPipe, &stdout)
+	go collect("stderr", stderrPipe, &stderr)
+	wg.Wait()
+
+	err = cmd.Wait()
+	return stdout.String(), stderr.String(), err
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WriteFileAtomic writes data to a temporary file next to path and renames it
+// over path, so a crash never leaves a truncated file. The file is only
+// readable by the owner.
+func WriteFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// WriteTemp stores data in a temporary file that root-only tools can read.
+// The caller removes it.
+func WriteTemp(data []byte) (string, error) {
+	tmp, err := os.CreateTemp("", "picontrol-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// InstallFile writes data to a root-owned path. The helper runs
+// unprivileged, so the file is staged in /tmp and copied with sudo install,
+// through run, which has the signature of RunCommand. A failed copy returns
+// its stderr as the error.
+func InstallFile(run func(name string, args ...string) (string, string, error), path string, data []byte) error {
+	tmp, err := WriteTemp(data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	_, errout, err := run("sudo", "install", "-D", "-m", "0644", tmp, path)
+	if err != nil && strings.TrimSpace(errout) != "" {
+		return errors.New(strings.TrimSpace(errout))
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+import { env } from '$env/dynamic/private';
+import { X509Certificate, createHash } from 'node:crypto';
+import { isIP } from 'node:net';
+import { connect } from 'node:tls';
+import type PocketBase from 'pocketbase';
+import { Agent, fetch, type RequestInit } from 'undici';
+
+// HelperTrustError means the helper at an address can't be trusted: it isn't
+// a known device, or it presented a different key than the one pinned.
+export class HelperTrustError extends Error {}
+
+// The helper serves HTTPS by default. Set HELPER_PROTOCOL=http for helpers
+// with TLS turned off.
+function helperProtocol() {
+    return env.HELPER_PROTOCOL === 'http' ? 'http' : 'https';
+}
+
+export function helperOrigin(ip: string) {
+    return `${helperProtocol()}://${ip}:8220`;
+}
+
+// publicKeyPin returns the SHA-256 of a certificate's public key (its DER
+// SubjectPublicKeyInfo) as colon-separated hex, the format of
+// tls.public_key_sha256 in the helper's /status.
+export function publicKeyPin(raw: Buffer) {
+    const spki = new X509Certificate(raw).publicKey.export({ type: 'spki', format: 'der' });
+    const hex = createHash('sha256').update(spki).digest('hex').toUpperCase();
+    return hex.match(/../g)!.join(':');
+}
+
+// pinnedAgent connects only to a helper presenting the pinned public key.
+// Helper certificates are self-signed, so instead of checking them against a
+// CA, the key is compared with the one seen on first contact. A null pin
+// accepts any key and reports it through onKey.
+function pinnedAgent(pin: string | null, onKey?: (pin: string) => void) {
+    return new Agent({
+        connect(opts, callback) {
+            let done = false;
+            const finish = (...args: [null, ReturnType<typeof connect>] | [Error, null]) => {
+                if (!done) {
+                    done = true;
+                    callback(...args);
+                }
+            };
+            const socket = connect({
+                host: opts.hostname,
+                port: Number(opts.port) || 443,
+                // IP addresses can't be sent as SNI
+                servername: isIP(opts.hostname) ? undefined : opts.servername || opts.hostname,
+                ALPNProtocols: ['http/1.1'],
+                rejectUnauthorized: false
+            });
+            socket.once('secureConnect', () => {
+                const cert = socket.getPeerCertificate();
+                const key = cert?.raw ? publicKeyPin(cert.raw) : '';
+                if (pin !== null && key !== pin) {
+                    socket.destroy();
+                    finish(
+                        new HelperTrustError(
+                            `Helper at ${opts.hostname} presented public key ${key || 'none'}, expected ${pin}`
+                        ),
+                        null
+                    );
+                    return;
+                }
+                onKey?.(key);
+                finish(null, socket);
+            });
+            socket.once('error', (error) => finish(error, null));
+        }
+    });
+}
+
+// One agent per pin keeps connections to a helper alive between requests.
+const agents = new Map<string, Agent>();
+
+function agentFor(pin: string) {
+    let agent = agents.get(pin);
+    if (!agent) {
+        agent = pinnedAgent(pin);
+        agents.set(pin, agent);
+    }
+    return agent;
+}
+
+// devicePin returns the public key pinned for the device at ip. On first
+// contact it pins the key the helper presents, after checking that the
+// helper reports the same key in /status.
+async function devicePin(pb: PocketBase, ip: string): Promise<string> {
+    let device;
+    try {
+        device = await pb.collection('devices').getFirstListItem(pb.filter('ip_addr = {:ip}', { ip }));
+    } catch {
+        throw new HelperTrustError(`No device with IP address ${ip}`);
+    }
+    if (device.helper_pin) {
+        return device.helper_pin;
+    }
+
+    let seen = '';
+    const agent = pinnedAgent(null, (key) => (seen = key));
+    let status: any;
+    try {
+        const response = await fetch(`${helperOrigin(ip)}/status`, { dispatcher: agent });
+        status = await response.json();
+    } finally {
+        await agent.close();
+    }
+    // A different key means something else terminates TLS in between
+    if (!seen || status?.tls?.public_key_sha256 !== seen) {
+        throw new HelperTrustError(`Helper at ${ip} did not report the public key it presented`);
+    }
+
+    const updated = await pb.collection('devices').update(device.id, { helper_pin: seen });
+    if (updated.helper_pin !== seen) {
+        throw new Error('The devices collection needs a helper_pin text field to pin helper certificates');
+    }
+    return seen;
+}
+
+// helperFetch sends a request to the helper of the device at ip. Over HTTPS,
+// the connection is pinned to the public key stored with the device.
+export async function helperFetch(pb: PocketBase, ip: string, path: string, init: RequestInit = {}) {
+    const url = `${helperOrigin(ip)}${path}`;
+    if (helperProtocol() === 'http') {
+        return fetch(url, init);
+    }
+    const pin = await devicePin(pb, ip);
+    try {
+        return await fetch(url, { ...init, dispatcher: agentFor(pin) });
+    } catch (error) {
+        // fetch wraps connection errors, a key mismatch among them
+        if (error instanceof Error && error.cause instanceof HelperTrustError) {
+            throw error.cause;
+        }
+        throw error;
+    }
+}
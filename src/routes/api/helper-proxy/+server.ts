@@ -1,31 +1,43 @@
 import { json } from '@sveltejs/kit';
 import type { RequestHandler } from './$types';
+import { HelperTrustError, helperFetch } from '$lib/server/helper';
 
-function buildHelperUrl(ip: string, endpoint: string) {
-    // Route authentication endpoints based on API documentation
-    if (endpoint === '' || endpoint === 'auth') {
+// Auth endpoints the helper serves at the root because they don't take a
+// session: login, token refresh and auth status. The rest of auth/*
+// (session, logout, regenerate) needs one and lives under /api.
+const ROOT_AUTH_ENDPOINTS = ['auth', 'auth/refresh', 'auth/status'];
+
+function buildHelperPath(endpoint: string) {
+    if (endpoint === '') {
         // POST /auth for TOTP login
-        return `http://${ip}:8220/auth`;
-    } else if (endpoint === 'auth/status') {
-        // GET /auth/status for auth status
-        return `http://${ip}:8220/auth/status`;
+        return '/auth';
+    } else if (ROOT_AUTH_ENDPOINTS.includes(endpoint)) {
+        return `/${endpoint}`;
     } else {
         // All other endpoints go to /api/*
-        return `http://${ip}:8220/api/${endpoint}`;
+        return `/api/${endpoint}`;
     }
 }
 
-function filterHeaders(headers: Headers) {
+// Headers naming the client. The helper takes the client address for its
+// auth lockout and audit log from X-Forwarded-For when the dashboard is one
+// of its trusted proxies, so the browser's values are dropped and the
+// header is set from the connection instead.
+const FORWARDING_HEADERS = ['x-forwarded-for', 'forwarded', 'x-real-ip'];
+
+function filterHeaders(headers: Headers, clientAddress: string) {
     const result: Record<string, string> = {};
     for (const [key, value] of headers.entries()) {
-        if (key.toLowerCase() !== 'cookie' && key.toLowerCase() !== 'host') {
+        const name = key.toLowerCase();
+        if (name !== 'cookie' && name !== 'host' && !FORWARDING_HEADERS.includes(name)) {
             result[key] = value;
         }
     }
+    result['x-forwarded-for'] = clientAddress;
     return result;
 }
 
-export const GET: RequestHandler = async ({ url, request, locals }) => {
+export const GET: RequestHandler = async ({ url, request, locals, getClientAddress }) => {
     // Check if user is authenticated
     if (!locals.pb || !locals.pb.authStore.isValid) {
         return json({ error: 'Unauthorized' }, { status: 401 });
@@ -35,7 +47,7 @@ export const GET: RequestHandler = async ({ url, request, locals }) => {
     if (!targetIp) {
         return json({ error: 'IP address is required' }, { status: 400 });
     }
-    let targetUrl = buildHelperUrl(targetIp, endpoint);
+    let targetPath = buildHelperPath(endpoint);
     // Copy all query params except 'ip' and 'endpoint'
     const queryParams = new URLSearchParams();
     for (const [key, value] of url.searchParams.entries()) {
@@ -45,11 +57,11 @@ export const GET: RequestHandler = async ({ url, request, locals }) => {
     }
     const queryString = queryParams.toString();
     if (queryString) {
-        targetUrl += `?${queryString}`;
+        targetPath += `?${queryString}`;
     }
     try {
-        const headers = filterHeaders(request.headers);
-        const response = await fetch(targetUrl, { headers });
+        const headers = filterHeaders(request.headers, getClientAddress());
+        const response = await helperFetch(locals.pb, targetIp, targetPath, { headers });
         if (!response.ok) {
             return json(
                 { error: `Failed to execute request: ${response.statusText}` },
@@ -60,11 +72,14 @@ export const GET: RequestHandler = async ({ url, request, locals }) => {
         return json(data);
     } catch (error) {
         console.error(`Error with API request:`, error);
+        if (error instanceof HelperTrustError) {
+            return json({ error: error.message }, { status: 502 });
+        }
         return json({ error: `Failed to connect to helper service` }, { status: 500 });
     }
 };
 
-export const POST: RequestHandler = async ({ url, request, locals }) => {
+export const POST: RequestHandler = async ({ url, request, locals, getClientAddress }) => {
     // Check if user is authenticated
     if (!locals.pb || !locals.pb.authStore.isValid) {
         return json({ error: 'Unauthorized' }, { status: 401 });
@@ -74,11 +89,11 @@ export const POST: RequestHandler = async ({ url, request, locals }) => {
     if (!targetIp) {
         return json({ error: 'IP address is required' }, { status: 400 });
     }
-    const targetUrl = buildHelperUrl(targetIp, endpoint);
+    const targetPath = buildHelperPath(endpoint);
     try {
-        const headers = filterHeaders(request.headers);
+        const headers = filterHeaders(request.headers, getClientAddress());
         const requestBody = await request.text();
-        const response = await fetch(targetUrl, {
+        const response = await helperFetch(locals.pb, targetIp, targetPath, {
             method: 'POST',
             headers,
             body: requestBody
@@ -93,6 +108,9 @@ export const POST: RequestHandler = async ({ url, request, locals }) => {
         return json(data);
     } catch (error) {
         console.error(`Error with API request:`, error);
+        if (error instanceof HelperTrustError) {
+            return json({ error: error.message }, { status: 502 });
+        }
         return json({ error: `Failed to connect to helper service` }, { status: 500 });
     }
 };
\ No newline at end of file
@@ -1,5 +1,6 @@
 import { json } from '@sveltejs/kit';
 import type { RequestHandler } from './$types';
+import { HelperTrustError, helperFetch } from '$lib/server/helper';
 
 export const GET: RequestHandler = async ({ url, locals }) => {
     // Check if user is authenticated
@@ -14,7 +15,7 @@ export const GET: RequestHandler = async ({ url, locals }) => {
     }
     
     try {
-        const response = await fetch(`http://${targetIp}:8220/status`);
+        const response = await helperFetch(locals.pb, targetIp, '/status');
         
         if (!response.ok) {
             return json(
@@ -36,6 +37,9 @@ export const GET: RequestHandler = async ({ url, locals }) => {
         return json(normalized);
     } catch (error) {
         console.error('Error fetching helper status:', error);
+        if (error instanceof HelperTrustError) {
+            return json({ error: error.message }, { status: 502 });
+        }
         return json({ error: 'Failed to connect to helper service' }, { status: 500 });
     }
 };
\ No newline at end of file